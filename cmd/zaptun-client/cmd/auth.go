@@ -5,23 +5,47 @@ import (
 	"os"
 
 	"github.com/harsh082ip/ZapTun/config"
+	"github.com/harsh082ip/ZapTun/internal/client"
 	"github.com/spf13/cobra"
 )
 
 var authCmd = &cobra.Command{
 	Use:   "auth [token]",
 	Short: "Saves your authtoken to the config file",
+	Long:  "Saves your authtoken to the config file. Run `auth login` to obtain one through the browser instead.",
 	Args:  cobra.ExactArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
-		token := args[0]
-		if err := config.WriteAuthToken(token); err != nil {
-			fmt.Printf("Error saving auth token: %v\n", err)
+		saveAuthToken(args[0])
+	},
+}
+
+var authLoginCmd = &cobra.Command{
+	Use:   "login",
+	Short: "Logs in through the browser and saves the authtoken",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		token, err := client.DeviceLogin(config.WebsiteURL(), func(code *client.DeviceCode) {
+			fmt.Printf("Open %s and enter the code %s\n", code.VerificationURI, code.UserCode)
+			fmt.Printf("or go straight to %s\n\n", code.VerificationURIComplete)
+			fmt.Println("Waiting for approval...")
+		})
+		if err != nil {
+			fmt.Printf("Login failed: %v\n", err)
 			os.Exit(1)
 		}
-		fmt.Println("Auth token successfully saved.")
+		saveAuthToken(token)
 	},
 }
 
+func saveAuthToken(token string) {
+	if err := config.WriteAuthToken(token); err != nil {
+		fmt.Printf("Error saving auth token: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Println("Auth token successfully saved.")
+}
+
 func init() {
+	authCmd.AddCommand(authLoginCmd)
 	rootCmd.AddCommand(authCmd)
 }
@@ -9,11 +9,16 @@ import (
 	"github.com/harsh082ip/ZapTun/config"
 	"github.com/harsh082ip/ZapTun/internal/client"
 	"github.com/harsh082ip/ZapTun/pkg/logger"
-	"github.com/harsh082ip/ZapTun/pkg/tunnel"
 	"github.com/rs/zerolog"
 	"github.com/spf13/cobra"
 )
 
+var (
+	subdomain string
+	allowIPs  []string
+	upstream  string
+)
+
 var httpCmd = &cobra.Command{
 	Use:   "http [local_port]",
 	Short: "Starts an HTTP tunnel to a running local port",
@@ -24,20 +29,38 @@ var httpCmd = &cobra.Command{
 			fmt.Println("Invalid port number.")
 			os.Exit(1)
 		}
-		startTunnel("http", localPort)
+		startTunnels(&client.Tunnel{Type: "http", LocalPort: localPort, Subdomain: subdomain})
 	},
 }
 
 func init() {
+	httpCmd.Flags().StringVarP(&subdomain, "subdomain", "s", "", "Request a stable subdomain, served as <subdomain>-<login>")
+	httpCmd.Flags().StringSliceVar(&allowIPs, "allow-ip", nil, "Only let visitors from these IPs or CIDR ranges through (repeatable)")
+	httpCmd.Flags().StringVar(&upstream, "upstream", "", "Speak HTTP/2 to the local service: h2c (e.g. gRPC) or h2 (over TLS)")
 	rootCmd.AddCommand(httpCmd)
 }
 
-func startTunnel(tunnelType string, localPort int) {
-	clientCfg, err := config.LoadClientConfig()
+func startTunnels(tunnels ...*client.Tunnel) {
+	clientCfg, err := config.LoadClientConfig(certFile == "")
 	if err != nil {
 		fmt.Printf("%v\n", err)
 		os.Exit(1)
 	}
+	clientCfg.Multiplexer = multiplexer
+	clientCfg.CertFile, clientCfg.KeyFile = certFile, keyFile
+	clientCfg.MaxIdleConns, clientCfg.IdleConnTimeout = maxIdleConns, idleConnTimeout
+
+	allowFrom, err := client.ParseAllowList(allowIPs)
+	if err != nil {
+		fmt.Printf("Invalid --allow-ip: %v\n", err)
+		os.Exit(1)
+	}
+	for _, t := range tunnels {
+		t.AllowFrom = allowFrom
+		if t.Type == "http" {
+			t.Upstream = upstream
+		}
+	}
 
 	logLevel := zerolog.Disabled
 	if debug {
@@ -47,10 +70,12 @@ func startTunnel(tunnelType string, localPort int) {
 	var logWriter io.Writer = os.Stdout
 	appLogger := logger.NewLogger(logWriter, logLevel, "zaptun-client")
 
-	controlMsg := &tunnel.ControlMessage{Type: tunnelType}
-
-	srv, _ := client.NewClient(controlMsg, clientCfg, localPort, appLogger)
-	appLogger.LogInfoMessage().Msgf("Starting Zaptun client for %s tunnel", tunnelType)
+	srv, err := client.NewClient(tunnels, clientCfg, appLogger)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		os.Exit(1)
+	}
+	appLogger.LogInfoMessage().Msgf("Starting Zaptun client for %d tunnel(s)", len(tunnels))
 
 	if err := srv.Start(logLevel); err != nil {
 		appLogger.LogFatalMessage().Err(err).Msg("Client failed to start")
@@ -0,0 +1,116 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/harsh082ip/ZapTun/config"
+	"github.com/harsh082ip/ZapTun/internal/client"
+	"github.com/harsh082ip/ZapTun/pkg/logger"
+	"github.com/harsh082ip/ZapTun/pkg/tunnel"
+	"github.com/rs/zerolog"
+	"github.com/spf13/cobra"
+)
+
+var reserveCmd = &cobra.Command{
+	Use:   "reserve",
+	Short: "Reserves a subdomain or TCP port that stays yours across restarts",
+}
+
+var reserveSubdomainCmd = &cobra.Command{
+	Use:   "subdomain [name]",
+	Short: "Reserves <name>-<login> for your HTTP tunnels",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		r, err := newCommandClient().Reserve(tunnel.ReservationSubdomain, args[0])
+		exitOnError(err)
+		fmt.Printf("Reserved subdomain %s, use it with: zaptun-client http <port> --subdomain %s\n", r.Name, r.Name)
+	},
+}
+
+var reserveTCPCmd = &cobra.Command{
+	Use:   "tcp",
+	Short: "Reserves a public TCP port for your TCP tunnels",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		r, err := newCommandClient().Reserve(tunnel.ReservationTCPPort, "")
+		exitOnError(err)
+		fmt.Printf("Reserved port %d, use it with: zaptun-client tcp <port> --remote-port %d\n", r.Port, r.Port)
+	},
+}
+
+var releaseCmd = &cobra.Command{
+	Use:   "release [subdomain|tcp] [name|port]",
+	Short: "Releases a reserved subdomain or TCP port",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		c := newCommandClient()
+		var err error
+		switch args[0] {
+		case "subdomain":
+			err = c.Release(tunnel.ReservationSubdomain, args[1], 0)
+		case "tcp":
+			port, convErr := strconv.Atoi(args[1])
+			if convErr != nil {
+				fmt.Println("Invalid port number.")
+				os.Exit(1)
+			}
+			err = c.Release(tunnel.ReservationTCPPort, "", port)
+		default:
+			fmt.Printf("Unknown reservation kind %q, expected subdomain or tcp.\n", args[0])
+			os.Exit(1)
+		}
+		exitOnError(err)
+		fmt.Printf("Released %s %s.\n", args[0], args[1])
+	},
+}
+
+var reservationsCmd = &cobra.Command{
+	Use:   "reservations",
+	Short: "Lists your reserved subdomains and TCP ports",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		reservations, err := newCommandClient().Reservations()
+		exitOnError(err)
+		if len(reservations) == 0 {
+			fmt.Println("No reservations.")
+			return
+		}
+		for _, r := range reservations {
+			name := r.Name
+			if r.Kind == tunnel.ReservationTCPPort {
+				name = strconv.Itoa(r.Port)
+			}
+			fmt.Printf("%-10s\t%s\t(since %s)\n", r.Kind, name, r.CreatedAt.Format("2006-01-02"))
+		}
+	},
+}
+
+func init() {
+	reserveCmd.AddCommand(reserveSubdomainCmd, reserveTCPCmd)
+	rootCmd.AddCommand(reserveCmd, releaseCmd, reservationsCmd)
+}
+
+// newCommandClient builds a client without tunnels for one-shot control commands.
+func newCommandClient() *client.Client {
+	clientCfg, err := config.LoadClientConfig(certFile == "")
+	exitOnError(err)
+	clientCfg.Multiplexer = multiplexer
+	clientCfg.CertFile, clientCfg.KeyFile = certFile, keyFile
+
+	logLevel := zerolog.Disabled
+	if debug {
+		logLevel = zerolog.DebugLevel
+	}
+	c, err := client.NewClient(nil, clientCfg, logger.NewLogger(os.Stdout, logLevel, "zaptun-client"))
+	exitOnError(err)
+	return c
+}
+
+func exitOnError(err error) {
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		os.Exit(1)
+	}
+}
@@ -3,13 +3,20 @@ package cmd
 import (
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/spf13/cobra"
 )
 
 var (
-	debug      bool
-	configPath string
+	debug       bool
+	configPath  string
+	multiplexer string
+	certFile    string
+	keyFile     string
+
+	maxIdleConns    int
+	idleConnTimeout time.Duration
 )
 
 var rootCmd = &cobra.Command{
@@ -28,4 +35,9 @@ func Execute() {
 func init() {
 	rootCmd.PersistentFlags().BoolVarP(&debug, "debug", "d", false, "Enable debug logging")
 	rootCmd.PersistentFlags().StringVarP(&configPath, "config", "c", "", "Path to config file")
+	rootCmd.PersistentFlags().StringVar(&multiplexer, "mux", "", "Stream multiplexer to use (yamux, yamux-tuned); the server picks by default")
+	rootCmd.PersistentFlags().StringVar(&certFile, "cert", "", "Client certificate (PEM) to authenticate with instead of the auth token")
+	rootCmd.PersistentFlags().StringVar(&keyFile, "key", "", "Private key (PEM) of the client certificate")
+	rootCmd.PersistentFlags().IntVar(&maxIdleConns, "max-idle-conns", 0, "Idle keep-alive connections kept open to the local service of each HTTP tunnel (default 64)")
+	rootCmd.PersistentFlags().DurationVar(&idleConnTimeout, "idle-conn-timeout", 0, "How long an idle connection to a local service is kept open (default 90s)")
 }
@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"os"
 
+	"github.com/harsh082ip/ZapTun/internal/client"
 	"github.com/spf13/cobra"
 )
 
@@ -47,7 +48,7 @@ and exposes it to the internet through a Zaptun HTTP tunnel.`,
 			}
 		}()
 
-		startTunnel("http", localPort)
+		startTunnels(&client.Tunnel{Type: "http", LocalPort: localPort})
 	},
 }
 
@@ -0,0 +1,66 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/harsh082ip/ZapTun/internal/client"
+	"github.com/spf13/cobra"
+)
+
+var (
+	startHTTPPorts []string
+	startTCPPorts  []string
+)
+
+var startCmd = &cobra.Command{
+	Use:   "start",
+	Short: "Starts several tunnels over a single connection",
+	Long: `Starts every tunnel given by the --http and --tcp flags over one authenticated session, e.g.
+
+  zaptun-client start --http 3000:web --http 8080:api --tcp 5432
+
+An HTTP port may be followed by ":<subdomain>" to request a stable subdomain, and a
+TCP port by ":<remote_port>" to use a public port reserved with "zaptun-client reserve tcp".`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		var tunnels []*client.Tunnel
+		for _, spec := range startHTTPPorts {
+			port, sub, _ := strings.Cut(spec, ":")
+			localPort, err := strconv.Atoi(port)
+			if err != nil {
+				fmt.Printf("Invalid port number in --http %s.\n", spec)
+				os.Exit(1)
+			}
+			tunnels = append(tunnels, &client.Tunnel{Type: "http", LocalPort: localPort, Subdomain: sub})
+		}
+		for _, spec := range startTCPPorts {
+			port, remote, _ := strings.Cut(spec, ":")
+			localPort, err := strconv.Atoi(port)
+			remotePort := 0
+			if err == nil && remote != "" {
+				remotePort, err = strconv.Atoi(remote)
+			}
+			if err != nil {
+				fmt.Printf("Invalid port number in --tcp %s.\n", spec)
+				os.Exit(1)
+			}
+			tunnels = append(tunnels, &client.Tunnel{Type: "tcp", LocalPort: localPort, RemotePort: remotePort})
+		}
+		if len(tunnels) == 0 {
+			fmt.Println("Nothing to start, pass at least one --http or --tcp port.")
+			os.Exit(1)
+		}
+		startTunnels(tunnels...)
+	},
+}
+
+func init() {
+	startCmd.Flags().StringSliceVar(&startHTTPPorts, "http", nil, "Local port to expose over HTTP, optionally port:subdomain (repeatable)")
+	startCmd.Flags().StringSliceVar(&startTCPPorts, "tcp", nil, "Local port to expose over TCP, optionally port:remote_port (repeatable)")
+	startCmd.Flags().StringSliceVar(&allowIPs, "allow-ip", nil, "Only let visitors from these IPs or CIDR ranges through (repeatable)")
+	startCmd.Flags().StringVar(&upstream, "upstream", "", "Speak HTTP/2 to the local services of the --http tunnels: h2c or h2")
+	rootCmd.AddCommand(startCmd)
+}
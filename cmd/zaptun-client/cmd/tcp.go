@@ -5,9 +5,12 @@ import (
 	"os"
 	"strconv"
 
+	"github.com/harsh082ip/ZapTun/internal/client"
 	"github.com/spf13/cobra"
 )
 
+var remotePort int
+
 var tcpCmd = &cobra.Command{
 	Use:   "tcp [local_port]",
 	Short: "Starts a TCP tunnel to a running local port",
@@ -18,10 +21,12 @@ var tcpCmd = &cobra.Command{
 			fmt.Println("Invalid port number.")
 			os.Exit(1)
 		}
-		startTunnel("tcp", localPort)
+		startTunnels(&client.Tunnel{Type: "tcp", LocalPort: localPort, RemotePort: remotePort})
 	},
 }
 
 func init() {
+	tcpCmd.Flags().IntVarP(&remotePort, "remote-port", "r", 0, "Use a public port you reserved with `zaptun-client reserve tcp`")
+	tcpCmd.Flags().StringSliceVar(&allowIPs, "allow-ip", nil, "Only let visitors from these IPs or CIDR ranges through (repeatable)")
 	rootCmd.AddCommand(tcpCmd)
 }
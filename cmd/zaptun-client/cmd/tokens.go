@@ -0,0 +1,54 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+var tokensCmd = &cobra.Command{
+	Use:   "tokens",
+	Short: "Lists the machines you are logged in on",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		tokens, err := newCommandClient().Tokens()
+		exitOnError(err)
+		if len(tokens) == 0 {
+			fmt.Println("No tokens.")
+			return
+		}
+		for _, t := range tokens {
+			current := ""
+			if t.Current {
+				current = "  (this machine)"
+			}
+			fmt.Printf("%s\t%-20s\tlast used %s\texpires %s%s\n", t.ID, t.Name,
+				t.LastUsedAt.Local().Format("2006-01-02 15:04"), t.ExpiresAt.Local().Format("2006-01-02"), current)
+		}
+	},
+}
+
+var tokensRenameCmd = &cobra.Command{
+	Use:   "rename [id] [name]",
+	Short: "Renames a machine token",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		exitOnError(newCommandClient().RenameToken(args[0], args[1]))
+		fmt.Printf("Renamed token %s to %s.\n", args[0], args[1])
+	},
+}
+
+var tokensRevokeCmd = &cobra.Command{
+	Use:   "revoke [id]",
+	Short: "Revokes a machine token and disconnects the tunnels using it",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		exitOnError(newCommandClient().RevokeToken(args[0]))
+		fmt.Printf("Revoked token %s.\n", args[0])
+	},
+}
+
+func init() {
+	tokensCmd.AddCommand(tokensRenameCmd, tokensRevokeCmd)
+	rootCmd.AddCommand(tokensCmd)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/harsh082ip/ZapTun/config"
+	"github.com/harsh082ip/ZapTun/internal/server/apikey"
+	"github.com/harsh082ip/ZapTun/internal/server/authcache"
+	"github.com/harsh082ip/ZapTun/internal/server/certauth"
+	"github.com/harsh082ip/ZapTun/internal/server/github"
+	"github.com/harsh082ip/ZapTun/internal/server/oidc"
+	"github.com/harsh082ip/ZapTun/pkg/db/redis"
+	log "github.com/harsh082ip/ZapTun/pkg/logger"
+)
+
+// newAuthenticator returns the authenticator selected by cfg.AuthBackend.
+func newAuthenticator(cfg *config.ServerConfig, store redis.RedisStoreWithRetries, logger *log.Logger) (github.Authenticator, error) {
+	switch cfg.AuthBackend {
+	case "", "github":
+		if cfg.GitHubClientID == "" || cfg.GitHubClientSecret == "" {
+			return nil, fmt.Errorf("missing github client id/secret")
+		}
+		endpoints := github.Endpoints{APIURL: cfg.GitHubAPIURL}
+		// every reconnect authenticates again, don't ask GitHub each time
+		return authcache.New(github.NewWithEndpoints(cfg.GitHubClientID, cfg.GitHubClientSecret, endpoints), store, authcache.Options{
+			TTL:         time.Duration(cfg.AuthCacheTTLSeconds) * time.Second,
+			NegativeTTL: time.Duration(cfg.AuthCacheNegativeTTLSeconds) * time.Second,
+			StaleTTL:    time.Duration(cfg.AuthCacheStaleSeconds) * time.Second,
+		}, logger), nil
+	case "apikey_file":
+		if cfg.APIKeysFile == "" {
+			return nil, fmt.Errorf("auth backend apikey_file needs api_keys_file")
+		}
+		return apikey.NewFile(cfg.APIKeysFile)
+	case "oidc":
+		if cfg.OIDCIssuer == "" || cfg.OIDCClientID == "" {
+			return nil, fmt.Errorf("auth backend oidc needs oidc_issuer and oidc_client_id")
+		}
+		return oidc.New(oidc.Config{
+			Issuer:      cfg.OIDCIssuer,
+			ClientID:    cfg.OIDCClientID,
+			LoginClaim:  cfg.OIDCLoginClaim,
+			GroupsClaim: cfg.OIDCGroupsClaim,
+		}), nil
+	case "mtls":
+		if cfg.ClientCAPath == "" {
+			return nil, fmt.Errorf("auth backend mtls needs client_ca_path")
+		}
+		return certauth.Load(cfg.ClientCAPath)
+	case "apikey_kv":
+		if cfg.RedisAddr == "" {
+			return nil, fmt.Errorf("auth backend apikey_kv needs redis_addr")
+		}
+		return apikey.NewKV(store), nil
+	default:
+		return nil, fmt.Errorf("unknown auth backend %q", cfg.AuthBackend)
+	}
+}
+
+// runAPIKeyCommand manages the keys of the apikey_kv backend:
+//
+//	zaptun-server apikey create -login alice [-name laptop] [-max-tunnels 5] [-plan pro]
+//	zaptun-server apikey delete <key or sha256>
+func runAPIKeyCommand(cfg *config.ServerConfig, store redis.RedisStoreWithRetries, args []string) {
+	usage := "usage: zaptun-server apikey create -login <login> [-name <name>] [-max-tunnels <n>] [-plan <plan>] | delete <key or sha256>"
+	if cfg.RedisAddr == "" {
+		fmt.Println("API keys are stored in redis, set redis_addr in the server config")
+		os.Exit(1)
+	}
+	if len(args) == 0 {
+		fmt.Println(usage)
+		os.Exit(1)
+	}
+
+	switch args[0] {
+	case "create":
+		var key apikey.Key
+		flags := flag.NewFlagSet("apikey create", flag.ExitOnError)
+		flags.StringVar(&key.Login, "login", "", "login the key authenticates as")
+		flags.StringVar(&key.Name, "name", "", "optional description of the key")
+		flags.IntVar(&key.MaxTunnels, "max-tunnels", 0, "HTTP and TCP tunnel limit for the key (0 uses the plan's)")
+		flags.StringVar(&key.Plan, "plan", "", "plan for the key (empty uses the server's plan assignment)")
+		flags.Parse(args[1:])
+		token, err := apikey.Create(store, key)
+		if err != nil {
+			fmt.Printf("Failed to create api key: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("API key for %s: %s\n", key.Login, token)
+		fmt.Printf("SHA-256: %s\n", apikey.Hash(token))
+		fmt.Println("Store it now, it cannot be shown again. Clients use it with `zaptun-client auth <key>`.")
+	case "delete":
+		if len(args) != 2 {
+			fmt.Println(usage)
+			os.Exit(1)
+		}
+		if err := apikey.Delete(store, args[1]); err != nil {
+			fmt.Printf("Failed to delete api key: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println("API key deleted")
+	default:
+		fmt.Println(usage)
+		os.Exit(1)
+	}
+}
@@ -7,7 +7,7 @@ import (
 
 	"github.com/harsh082ip/ZapTun/config"
 	"github.com/harsh082ip/ZapTun/internal/server"
-	"github.com/harsh082ip/ZapTun/internal/server/github"
+	"github.com/harsh082ip/ZapTun/pkg/db/redis"
 	"github.com/harsh082ip/ZapTun/pkg/logger"
 	"github.com/rs/zerolog"
 )
@@ -18,10 +18,6 @@ func main() {
 		log.Fatalf("Failed to load server config: %v", err)
 	}
 
-	if cfg.GitHubClientID == "" || cfg.GitHubClientSecret == "" {
-		log.Fatalf("missing github client id/secret")
-	}
-
 	var logWriter io.Writer = os.Stdout
 	if cfg.LogFile != "" {
 		file, err := os.OpenFile(cfg.LogFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
@@ -38,10 +34,36 @@ func main() {
 	}
 
 	appLogger := logger.NewLogger(logWriter, logLevel, "tunnel-server")
-	oauth := github.New(cfg.GitHubClientID, cfg.GitHubClientSecret)
+	var store redis.RedisStoreWithRetries
+	if cfg.RedisAddr != "" {
+		store, err = redis.NewRedisClient(cfg.RedisAddr, cfg.RedisPassword, cfg.RedisDB)
+		if err != nil {
+			log.Fatalf("Failed to connect to redis: %v", err)
+		}
+		defer store.Close()
+	} else {
+		appLogger.LogWarnMessage().Msg("No redis_addr configured, reservations are kept in memory and lost on restart")
+		store = redis.NewMemoryStore()
+	}
+
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "apikey":
+			runAPIKeyCommand(cfg, store, os.Args[2:])
+			return
+		case "plan":
+			runPlanCommand(cfg, store, os.Args[2:])
+			return
+		}
+	}
+
+	oauth, err := newAuthenticator(cfg, store, appLogger)
+	if err != nil {
+		log.Fatalf("Failed to set up authentication: %v", err)
+	}
 
 	// start the server
-	srv := server.NewServer(cfg, appLogger, oauth)
+	srv := server.NewServer(cfg, appLogger, oauth, store)
 	appLogger.LogInfoMessage().Msg("Starting Zaptun server...")
 	if err := srv.Start(); err != nil {
 		appLogger.LogFatalMessage().Err(err).Msg("Server failed to start")
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/harsh082ip/ZapTun/config"
+	"github.com/harsh082ip/ZapTun/internal/server"
+	"github.com/harsh082ip/ZapTun/pkg/db/redis"
+)
+
+// runPlanCommand assigns plans to users in redis, overriding user_plans and
+// org_plans from the config:
+//
+//	zaptun-server plan set <login> <plan>
+//	zaptun-server plan unset <login>
+func runPlanCommand(cfg *config.ServerConfig, store redis.RedisStoreWithRetries, args []string) {
+	usage := "usage: zaptun-server plan set <login> <plan> | unset <login>"
+	if cfg.RedisAddr == "" {
+		fmt.Println("Plan assignments are stored in redis, set redis_addr in the server config")
+		os.Exit(1)
+	}
+
+	var err error
+	switch {
+	case len(args) == 3 && args[0] == "set":
+		if _, ok := cfg.Plans[args[2]]; !ok && args[2] != "free" {
+			fmt.Printf("Plan %q is not defined in the server config\n", args[2])
+			os.Exit(1)
+		}
+		err = server.AssignPlan(store, args[1], args[2])
+	case len(args) == 2 && args[0] == "unset":
+		err = server.AssignPlan(store, args[1], "")
+	default:
+		fmt.Println(usage)
+		os.Exit(1)
+	}
+	if err != nil {
+		fmt.Printf("Failed to update plan: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Println("Plan updated, it applies from the user's next connection")
+}
@@ -6,6 +6,10 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/harsh082ip/ZapTun/pkg/tunnel"
 )
 
 const (
@@ -14,18 +18,135 @@ const (
 )
 
 var localConfig = ".zaptun-config"
-var remoteConfig = "https://zaptun.com/config.json"
+var websiteURL = "https://zaptun.com"
 
 type ServerConfig struct {
-	Domain             string `json:"domain"`
-	ControlPlaneAddr   string `json:"control_plane_addr"`
-	DataPlaneAddr      string `json:"data_plane_addr"`
-	LogFile            string `json:"log_file"`
-	LogLevel           string `json:"log_level"`
-	CertificatePath    string `json:"certificate_path"`
-	PrivateKeyPath     string `json:"private_key_path"`
-	GitHubClientID     string `json:"github_client_id"`
-	GitHubClientSecret string `json:"github_client_secret"`
+	Domain           string `json:"domain"`
+	ControlPlaneAddr string `json:"control_plane_addr"`
+	DataPlaneAddr    string `json:"data_plane_addr"`
+	LogFile          string `json:"log_file"`
+	LogLevel         string `json:"log_level"`
+	CertificatePath  string `json:"certificate_path"`
+	PrivateKeyPath   string `json:"private_key_path"`
+	// With DataPlaneTLSAddr set the data plane also serves HTTPS itself, so no
+	// reverse proxy is needed. Tunnel hosts get the certificate for *.<domain>
+	// (WildcardCertificatePath, default CertificatePath), other hosts the one
+	// listed for them in HostCertificates, selected by SNI. RedirectHTTPToHTTPS
+	// answers plain HTTP requests with a redirect to HTTPS.
+	DataPlaneTLSAddr        string            `json:"data_plane_tls_addr"`
+	WildcardCertificatePath string            `json:"wildcard_certificate_path"`
+	WildcardPrivateKeyPath  string            `json:"wildcard_private_key_path"`
+	HostCertificates        []HostCertificate `json:"host_certificates"`
+	RedirectHTTPToHTTPS     bool              `json:"redirect_http_to_https"`
+	GitHubClientID          string            `json:"github_client_id"`
+	GitHubClientSecret      string            `json:"github_client_secret"`
+	// AuthBackend selects how client tokens are checked: "github" (default),
+	// "apikey_file" for keys listed in APIKeysFile, "apikey_kv" for keys kept
+	// in the KV store and managed with `zaptun-server apikey`, "oidc" for ID tokens
+	// of the OpenID Connect provider OIDCIssuer, or "mtls" to accept client
+	// certificates only.
+	AuthBackend string `json:"auth_backend"`
+	APIKeysFile string `json:"api_keys_file"`
+	// ClientCAPath is a PEM bundle of CAs whose client certificates identify users
+	// by their subject. With any backend but "mtls" certificates are optional and
+	// clients without one authenticate with their token as usual.
+	ClientCAPath string `json:"client_ca_path"`
+	// GitHubAPIURL points the github backend at another API, e.g. GitHub Enterprise.
+	GitHubAPIURL string `json:"github_api_url"`
+	// The oidc backend accepts ID tokens issued by OIDCIssuer for OIDCClientID. The
+	// login comes from OIDCLoginClaim (default sub, hashed unless it is a valid
+	// login; only pick a claim the provider keeps unique and unchangeable) and the
+	// groups in OIDCGroupsClaim (default groups) count as orgs.
+	OIDCIssuer      string `json:"oidc_issuer"`
+	OIDCClientID    string `json:"oidc_client_id"`
+	OIDCLoginClaim  string `json:"oidc_login_claim"`
+	OIDCGroupsClaim string `json:"oidc_groups_claim"`
+	// Successful GitHub token checks are cached for AuthCacheTTLSeconds (default 300)
+	// and still used for AuthCacheStaleSeconds more (default 3600) while GitHub is
+	// unreachable; rejected tokens are cached for AuthCacheNegativeTTLSeconds (default 30).
+	AuthCacheTTLSeconds         int `json:"auth_cache_ttl_seconds"`
+	AuthCacheNegativeTTLSeconds int `json:"auth_cache_negative_ttl_seconds"`
+	AuthCacheStaleSeconds       int `json:"auth_cache_stale_seconds"`
+	// After the first connect clients that logged in with GitHub or OIDC get a
+	// server-signed session credential valid for CredentialTTLHours (default 168)
+	// and stop sending their provider token. Past half of that the client sends the
+	// provider token along, and the credential is renewed once the provider accepts
+	// it again, for at most CredentialMaxLifetimeHours (default 720) after the first
+	// credential. CredentialSecret is the signing key; when empty a random one is
+	// kept in the KV store. Credentials need RedisAddr and are off without it.
+	DisableCredentials         bool   `json:"disable_credentials"`
+	CredentialTTLHours         int    `json:"credential_ttl_hours"`
+	CredentialMaxLifetimeHours int    `json:"credential_max_lifetime_hours"`
+	CredentialSecret           string `json:"credential_secret"`
+	// An address or token with AuthMaxFailures rejected logins (default 10, negative
+	// disables lockouts) within AuthFailureWindowSeconds (default 600) is locked out
+	// for AuthLockoutSeconds (default 900). Counters live in the KV store, so every
+	// server sharing it applies them. At most MaxPendingSessions (default 256)
+	// connections, MaxPendingSessionsPerIP (default 8) per address, may be in the
+	// middle of authenticating at any time.
+	AuthMaxFailures          int `json:"auth_max_failures"`
+	AuthFailureWindowSeconds int `json:"auth_failure_window_seconds"`
+	AuthLockoutSeconds       int `json:"auth_lockout_seconds"`
+	MaxPendingSessions       int `json:"max_pending_sessions"`
+	MaxPendingSessionsPerIP  int `json:"max_pending_sessions_per_ip"`
+	// Redis backs persistent state such as reserved subdomains and ports.
+	// When RedisAddr is empty an in-memory store is used instead.
+	RedisAddr     string `json:"redis_addr"`
+	RedisPassword string `json:"redis_password"`
+	RedisDB       int    `json:"redis_db"`
+	// Heartbeats over the control stream; a session that stays silent for the
+	// timeout is torn down. Zero values fall back to 15s and 45s.
+	HeartbeatIntervalSeconds int `json:"heartbeat_interval_seconds"`
+	HeartbeatTimeoutSeconds  int `json:"heartbeat_timeout_seconds"`
+	// On SIGTERM in-flight requests and streams get ShutdownTimeoutSeconds (default 30)
+	// to finish; clients are told to reconnect after ReconnectHintSeconds (default 5).
+	ShutdownTimeoutSeconds int `json:"shutdown_timeout_seconds"`
+	ReconnectHintSeconds   int `json:"reconnect_hint_seconds"`
+	// How long the address of a disconnected tunnel is kept for a client that
+	// resumes with its resume token (default 60).
+	ResumeGraceSeconds int `json:"resume_grace_seconds"`
+	// Stream multiplexers offered to clients, in order of preference, e.g.
+	// ["yamux-tuned", "yamux"]. Empty offers every built-in one, yamux first.
+	Multiplexers []string `json:"multiplexers"`
+	// Policy decides which authenticated users may open tunnels. It is re-read from
+	// this file on SIGHUP and whenever the file changes.
+	Policy PolicyConfig `json:"policy"`
+	// Plans by name, with the limits they grant. A user gets the plan set by the
+	// authenticator (API keys) or with `zaptun-server plan set`, else the one
+	// listed for their login in UserPlans or for one of their orgs in OrgPlans,
+	// else DefaultPlan. Without any of these the built-in "free" plan applies.
+	Plans       map[string]tunnel.Plan `json:"plans"`
+	UserPlans   map[string]string      `json:"user_plans"`
+	OrgPlans    map[string]string      `json:"org_plans"`
+	DefaultPlan string                 `json:"default_plan"`
+
+	path string
+}
+
+// PolicyConfig is the authorization policy applied after authentication. Denied
+// logins always lose; if any allow list is set, a user must match one of them.
+// Logins, orgs and teams are compared case-insensitively.
+type PolicyConfig struct {
+	AllowLogins []string `json:"allow_logins"`
+	AllowOrgs   []string `json:"allow_orgs"`
+	AllowTeams  []string `json:"allow_teams"` // "org/team-slug"
+	DenyLogins  []string `json:"deny_logins"`
+	// MinAccountAgeDays rejects accounts created more recently. Users without a
+	// known creation date, such as API key users, are not subject to it.
+	MinAccountAgeDays int `json:"min_account_age_days"`
+}
+
+// HostCertificate is the certificate served for Host, an exact name or a
+// wildcard such as "*.eu.example.com".
+type HostCertificate struct {
+	Host            string `json:"host"`
+	CertificatePath string `json:"certificate_path"`
+	PrivateKeyPath  string `json:"private_key_path"`
+}
+
+// Path returns the file the config was loaded from.
+func (c *ServerConfig) Path() string {
+	return c.path
 }
 
 type ClientConfig struct {
@@ -34,7 +155,24 @@ type ClientConfig struct {
 	}
 	Local struct {
 		AuthToken string `json:"auth_token"`
+		// ProviderToken is the login token a session credential in AuthToken was
+		// issued for, used again when the server no longer accepts the credential
+		ProviderToken string `json:"provider_token,omitempty"`
+		// CredentialRenewAt is when the credential is due for renewal, from then on
+		// the provider token is sent along (unix seconds)
+		CredentialRenewAt int64 `json:"credential_renew_at,omitempty"`
 	}
+	// Multiplexer forces a stream multiplexer instead of letting the server pick.
+	Multiplexer string `json:"-"`
+	// CertFile and KeyFile are a client certificate presented to servers that
+	// authenticate with certificates instead of tokens.
+	CertFile string `json:"-"`
+	KeyFile  string `json:"-"`
+	// Connections to the local services of http tunnels are kept alive and reused;
+	// at most MaxIdleConns (default 64) per tunnel stay open while idle, each for
+	// up to IdleConnTimeout (default 90s).
+	MaxIdleConns    int           `json:"-"`
+	IdleConnTimeout time.Duration `json:"-"`
 }
 
 func LoadServerConfig(path string) (*ServerConfig, error) {
@@ -55,11 +193,14 @@ func LoadServerConfig(path string) (*ServerConfig, error) {
 	if err != nil {
 		return nil, err
 	}
+	cfg.path = path
 
 	return &cfg, nil
 }
 
-func LoadClientConfig() (*ClientConfig, error) {
+// LoadClientConfig reads the saved auth token and fetches the remote config. A
+// missing token is only an error when requireToken is set.
+func LoadClientConfig(requireToken bool) (*ClientConfig, error) {
 	var c ClientConfig
 	configDir, err := os.UserConfigDir()
 	if err != nil {
@@ -67,12 +208,15 @@ func LoadClientConfig() (*ClientConfig, error) {
 	}
 	filePath := filepath.Join(configDir, "zaptun", localConfig)
 	data, err := os.ReadFile(filePath)
-	if err != nil {
-		return nil, fmt.Errorf("error: no auth token, obtain at https://zaptun.com/auth")
+	if err != nil && requireToken {
+		return nil, fmt.Errorf("error: no auth token, run `zaptun-client auth login` or obtain one at %s/auth", WebsiteURL())
 	}
-	if err := json.Unmarshal(data, &c.Local); err != nil {
-		return nil, fmt.Errorf("error unmarshaling config file contents: %s", err)
+	if err == nil {
+		if err := json.Unmarshal(data, &c.Local); err != nil {
+			return nil, fmt.Errorf("error unmarshaling config file contents: %s", err)
+		}
 	}
+	remoteConfig := WebsiteURL() + "/config.json"
 	response, err := http.Get(remoteConfig)
 	if err != nil || response.StatusCode != http.StatusOK {
 		return nil, fmt.Errorf("error fetching %s: %s", remoteConfig, err)
@@ -85,9 +229,32 @@ func LoadClientConfig() (*ClientConfig, error) {
 	return &c, nil
 }
 
+// WebsiteURL returns the zaptun website the client fetches its remote config from
+// and logs in through. ZAPTUN_WEBSITE_URL overrides it for self-hosted setups.
+func WebsiteURL() string {
+	if u := os.Getenv("ZAPTUN_WEBSITE_URL"); u != "" {
+		return strings.TrimRight(u, "/")
+	}
+	return websiteURL
+}
+
 func WriteAuthToken(token string) error {
 	var c ClientConfig
 	c.Local.AuthToken = token
+	return writeLocalConfig(&c)
+}
+
+// WriteCredential saves a session credential together with the provider token
+// it was issued for and when it is due for renewal.
+func WriteCredential(credential, providerToken string, renewAt time.Time) error {
+	var c ClientConfig
+	c.Local.AuthToken = credential
+	c.Local.ProviderToken = providerToken
+	c.Local.CredentialRenewAt = renewAt.Unix()
+	return writeLocalConfig(&c)
+}
+
+func writeLocalConfig(c *ClientConfig) error {
 	content, err := json.Marshal(c.Local)
 	if err != nil {
 		return fmt.Errorf("error marshaling config: %s", err)
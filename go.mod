@@ -1,11 +1,12 @@
 module github.com/harsh082ip/ZapTun
 
-go 1.23.3
+go 1.24
 
 require (
 	github.com/go-redis/redis v6.15.9+incompatible
 	github.com/hashicorp/yamux v0.1.2
 	github.com/rs/zerolog v1.34.0
+	github.com/spf13/cobra v1.9.1
 )
 
 require (
@@ -14,7 +15,6 @@ require (
 	github.com/mattn/go-isatty v0.0.19 // indirect
 	github.com/onsi/ginkgo v1.16.5 // indirect
 	github.com/onsi/gomega v1.37.0 // indirect
-	github.com/spf13/cobra v1.9.1 // indirect
 	github.com/spf13/pflag v1.0.7 // indirect
 	golang.org/x/sys v0.31.0 // indirect
 )
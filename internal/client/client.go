@@ -2,37 +2,94 @@ package client
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/harsh082ip/ZapTun/config"
+	"github.com/harsh082ip/ZapTun/internal/mux"
 	"github.com/harsh082ip/ZapTun/pkg/logger"
 	"github.com/harsh082ip/ZapTun/pkg/tunnel"
-	"github.com/hashicorp/yamux"
 	"github.com/rs/zerolog"
 )
 
+// Tunnel is a local service to expose through the session.
+type Tunnel struct {
+	Type       string // http or tcp
+	LocalPort  int
+	Subdomain  string
+	RemotePort int // reserved public port for tcp tunnels
+	// AllowFrom limits the visitors that reach the local service; empty allows everyone
+	AllowFrom []*net.IPNet
+	// Upstream is the protocol of the local service of an http tunnel, UpstreamH2C
+	// or UpstreamH2; empty for HTTP/1.1
+	Upstream string
+
+	publicAddr  string // assigned by the server
+	resumeToken string // reclaims publicAddr after a reconnect
+	dialer      *localDialer
+	transport   *http.Transport // pooled connections to the local service of http tunnels
+}
+
 type Client struct {
 	serverAddr string
-	localPort  int
-	controlMsg *tunnel.ControlMessage
-	conf       *config.ClientConfig
-	logLevel   zerolog.Level
-	logger     *logger.Logger
+	tunnels    []*Tunnel
+	routes     map[string]*Tunnel // tunnel ID -> tunnel, rebuilt on every connect
+	online     bool               // set once the tunnels went live for the first time
+	latency    time.Duration      // control stream RTT from the latest heartbeat
+	recent     []string           // latest incoming requests, shown on the status screen
+	status     string             // shown on the status screen
+	plan       *tunnel.Plan       // limits reported by the server, nil for old servers
+	certs      []tls.Certificate  // client certificate presented to the control plane, if any
+	// reconnectAfter overrides the retry delay after the server announced a restart
+	reconnectAfter time.Duration
+	mutex          sync.RWMutex
+	conf           *config.ClientConfig
+	logLevel       zerolog.Level
+	logger         *logger.Logger
 }
 
-func NewClient(controlMsg *tunnel.ControlMessage, conf *config.ClientConfig, localPort int, log *logger.Logger) (*Client, error) {
+func NewClient(tunnels []*Tunnel, conf *config.ClientConfig, log *logger.Logger) (*Client, error) {
+	if conf.Multiplexer != "" {
+		if _, err := mux.Get(conf.Multiplexer); err != nil {
+			return nil, err
+		}
+	}
+	var certs []tls.Certificate
+	if conf.CertFile != "" || conf.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(conf.CertFile, conf.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		certs = append(certs, cert)
+	}
+	for _, t := range tunnels {
+		t.dialer = newLocalDialer(t.LocalPort)
+		if t.Type != "http" {
+			if t.Upstream != "" {
+				return nil, fmt.Errorf("upstream protocol %s is only supported for http tunnels", t.Upstream)
+			}
+			continue
+		}
+		transport, err := newLocalTransport(t.Upstream, t.dialer, conf)
+		if err != nil {
+			return nil, err
+		}
+		t.transport = transport
+	}
 	return &Client{
+		certs:      certs,
 		serverAddr: conf.Remote.ServerAddr,
-		localPort:  localPort,
-		controlMsg: controlMsg,
+		tunnels:    tunnels,
+		routes:     make(map[string]*Tunnel),
 		logger:     log,
 		conf:       conf,
 		logLevel:   zerolog.Disabled,
@@ -40,162 +97,446 @@ func NewClient(controlMsg *tunnel.ControlMessage, conf *config.ClientConfig, loc
 }
 
 func (c *Client) Start(logLevel zerolog.Level) error {
+	if len(c.tunnels) == 0 {
+		return fmt.Errorf("at least one tunnel is required")
+	}
 	c.logger.LogInfoMessage().Msgf("Connecting to server at %s", c.serverAddr)
-	c.logger.LogInfoMessage().Msgf("Will forward traffic to localhost:%d", c.localPort)
+	for _, t := range c.tunnels {
+		c.logger.LogInfoMessage().Msgf("Will forward %s traffic to localhost:%d", t.Type, t.LocalPort)
+	}
 	c.logLevel = logLevel
 	for {
 		if err := c.connectAndServe(); err != nil {
-			c.logger.LogErrorMessage().Err(err).Msg("Connection error. Retrying in 5 seconds...")
+			c.logger.LogErrorMessage().Err(err).Msgf("Connection error. Retrying in %s...", c.retryDelay())
 		}
-		time.Sleep(5 * time.Second)
+		time.Sleep(c.retryDelay())
 	}
 }
 
-func (c *Client) connectAndServe() error {
+// controlSession is an authenticated connection to the control plane.
+type controlSession struct {
+	mux       mux.Session
+	ctrl      *tunnel.ControlConn
+	auth      *tunnel.AuthResult
+	heartbeat *tunnel.Heartbeat // nil if the server does not support heartbeats
+}
+
+// Close stops the heartbeat and tears down the session and its connection.
+func (cs *controlSession) Close() error {
+	if cs.heartbeat != nil {
+		cs.heartbeat.Stop()
+	}
+	return cs.mux.Close()
+}
+
+// dial connects to the control plane, opens the control stream and performs the
+// hello handshake.
+func (c *Client) dial() (*controlSession, error) {
+	// offer every multiplexer and let the server pick, unless one was forced
+	offered := mux.Names()
+	if c.conf.Multiplexer != "" {
+		offered = []string{c.conf.Multiplexer}
+	}
 	tlsConfig := &tls.Config{
 		// InsecureSkipVerify: true,
+		NextProtos:   mux.ALPN(offered),
+		Certificates: c.certs,
 	}
 	conn, err := tls.Dial("tcp", c.serverAddr, tlsConfig)
 	if err != nil {
-		return fmt.Errorf("failed to connect to control plane server: %w", err)
+		return nil, fmt.Errorf("failed to connect to control plane server: %w", err)
+	}
+	m, err := mux.Negotiated(conn.ConnectionState().NegotiatedProtocol, offered)
+	if err != nil {
+		conn.Close()
+		return nil, err
 	}
-	defer conn.Close()
-
-	yamuxConfig := yamux.DefaultConfig()
-	yamuxConfig.EnableKeepAlive = false
 
-	session, err := yamux.Client(conn, yamuxConfig)
+	session, err := m.Client(conn)
 	if err != nil {
-		return fmt.Errorf("failed to establish yamux session: %w", err)
+		conn.Close()
+		return nil, fmt.Errorf("failed to establish %s session: %w", m.Name(), err)
 	}
-	defer session.Close()
+	c.logger.LogDebugMessage().Msgf("Using %s multiplexer", m.Name())
 
 	ctrlStream, err := session.OpenStream()
 	if err != nil {
-		return fmt.Errorf("failed to open control stream: %w", err)
+		session.Close()
+		return nil, fmt.Errorf("failed to open control stream: %w", err)
 	}
-	defer ctrlStream.Close()
 
-	// send access token
-	err = json.NewEncoder(ctrlStream).Encode(c.conf.Local.AuthToken)
+	ctrl := tunnel.NewControlConn(ctrlStream)
+	hostname, _ := os.Hostname()
+	err = ctrl.Send(&tunnel.Message{
+		Type: tunnel.MsgHello,
+		Hello: &tunnel.Hello{
+			ProtocolVersion: tunnel.ProtocolVersion,
+			ClientVersion:   tunnel.Version,
+			Token:           c.conf.Local.AuthToken,
+			Features:        tunnel.SupportedFeatures,
+			MachineName:     hostname,
+			ProviderToken:   c.renewalToken(),
+		},
+	})
 	if err != nil {
-		return fmt.Errorf("failed to send control message: %w", err)
+		session.Close()
+		return nil, fmt.Errorf("failed to send hello: %w", err)
 	}
 
-	authResp, err := bufio.NewReader(ctrlStream).ReadString('\n')
+	msg, err := c.expect(ctrl, tunnel.MsgAuthResult)
 	if err != nil {
-		fmt.Printf("failed to read auth response: %v", err)
-		os.Exit(1)
+		session.Close()
+		var serverErr *tunnel.Error
+		// a revoked machine stays locked out, any other rejection may just mean the
+		// server lost its signing key
+		if errors.As(err, &serverErr) && serverErr.Code == tunnel.ErrAuthFailed &&
+			serverErr.Reason != tunnel.AuthTokenRevoked && c.fallBackToProviderToken() {
+			return nil, fmt.Errorf("session credential rejected: %w", err)
+		}
+		exitOnServerError(err)
+		return nil, fmt.Errorf("failed to read auth response: %w", err)
 	}
-	authResp = strings.TrimSpace(authResp)
-	if authResp != "auth_ok" {
-		fmt.Printf("%s\n", authResp)
-		os.Exit(1)
+	auth := msg.AuthResult
+	c.logger.LogInfoMessage().Msgf("Authenticated as %s (server %s, protocol v%d)",
+		auth.Login, auth.ServerVersion, auth.ProtocolVersion)
+	if auth.Plan != nil {
+		c.logger.LogInfoMessage().Msgf("Plan: %s", describePlan(auth.Plan))
+	}
+	if auth.Credential != "" {
+		// the server's own credential is sent from now on, the provider token is
+		// kept in case the server forgets the credential
+		if !strings.HasPrefix(c.conf.Local.AuthToken, tunnel.CredentialPrefix) {
+			c.conf.Local.ProviderToken = c.conf.Local.AuthToken
+		}
+		c.conf.Local.AuthToken = auth.Credential
+		// renew at half of the remaining lifetime, as the server does
+		now := time.Now()
+		renewAt := now.Add(time.Unix(auth.CredentialExpiresAt, 0).Sub(now) / 2)
+		c.conf.Local.CredentialRenewAt = renewAt.Unix()
+		if err := config.WriteCredential(auth.Credential, c.conf.Local.ProviderToken, renewAt); err != nil {
+			c.logger.LogWarnMessage().Err(err).Msg("Failed to save session credential")
+		} else {
+			c.logger.LogDebugMessage().Msgf("Saved session credential valid until %s",
+				time.Unix(auth.CredentialExpiresAt, 0).Format(time.RFC3339))
+		}
 	}
 
-	err = json.NewEncoder(ctrlStream).Encode(c.controlMsg)
-	if err != nil {
-		return fmt.Errorf("failed to send control message: %w", err)
+	cs := &controlSession{mux: session, ctrl: ctrl, auth: auth}
+	if auth.HeartbeatIntervalMs > 0 {
+		timeout := time.Duration(auth.HeartbeatTimeoutMs) * time.Millisecond
+		cs.heartbeat = ctrl.StartHeartbeat(time.Duration(auth.HeartbeatIntervalMs)*time.Millisecond, timeout,
+			func() {
+				// closing the session fails AcceptStream, which makes Start reconnect
+				c.logger.LogWarnMessage().Msgf("No heartbeat from server for %s, reconnecting", timeout)
+				session.Close()
+			},
+			c.setLatency)
 	}
-	// log.Println(c.controlMsg)
+	return cs, nil
+}
 
-	response, err := bufio.NewReader(ctrlStream).ReadString('\n')
-	if err != nil {
-		return fmt.Errorf("failed to read response from server: %w", err)
+// renewalToken returns the provider token to send along with a session credential
+// that is due for renewal, the server checks it with the identity provider before
+// renewing the credential.
+func (c *Client) renewalToken() string {
+	if !strings.HasPrefix(c.conf.Local.AuthToken, tunnel.CredentialPrefix) || time.Now().Unix() < c.conf.Local.CredentialRenewAt {
+		return ""
+	}
+	return c.conf.Local.ProviderToken
+}
+
+// fallBackToProviderToken replaces a session credential the server rejected with
+// the provider token it was issued for. It returns false when there is none.
+func (c *Client) fallBackToProviderToken() bool {
+	if c.conf.Local.ProviderToken == "" || !strings.HasPrefix(c.conf.Local.AuthToken, tunnel.CredentialPrefix) {
+		return false
 	}
-	response = strings.TrimSpace(response)
-	iserrorMsg := strings.Contains(response, "err:")
-	if iserrorMsg {
-		fmt.Println(response)
-		os.Exit(1)
+	c.logger.LogWarnMessage().Msg("Server rejected the session credential, retrying with the saved login token")
+	c.conf.Local.AuthToken, c.conf.Local.ProviderToken = c.conf.Local.ProviderToken, ""
+	if err := config.WriteAuthToken(c.conf.Local.AuthToken); err != nil {
+		c.logger.LogWarnMessage().Err(err).Msg("Failed to save login token")
 	}
+	return true
+}
 
-	if c.controlMsg.Type == "http" {
-		if c.logLevel == zerolog.Disabled {
-			fmt.Print("\033[H\033[2J") // clear
-			fmt.Printf("Status: \t Online \n")
-			fmt.Printf("Protocol: \t %s \n", strings.ToUpper(c.controlMsg.Type))
-			fmt.Printf("Forwarding: \t %s -> %s \n",
-				fmt.Sprintf("https://%s", response),
-				fmt.Sprintf("http://localhost:%d", c.localPort))
-		}
-		c.logger.LogInfoMessage().Msgf("Tunnel is live at: http://%s", response)
+func (c *Client) connectAndServe() error {
+	cs, err := c.dial()
+	if err != nil {
+		return err
+	}
+	defer cs.Close()
+	session, ctrl := cs.mux, cs.ctrl
 
-	} else {
-		if c.logLevel == zerolog.Disabled {
-			fmt.Print("\033[H\033[2J") // clear
-			fmt.Printf("Status: \t Online \n")
-			fmt.Printf("Protocol: \t %s \n", strings.ToUpper(c.controlMsg.Type))
-			fmt.Printf("Forwarding:\t %s -> %s\n",
-				fmt.Sprintf("tcp://%s", response),
-				fmt.Sprintf("tcp://localhost:%d", c.localPort),
-			)
+	routes := make(map[string]*Tunnel)
+	for _, t := range c.tunnels {
+		req := &tunnel.TunnelRequest{Type: t.Type, Subdomain: t.Subdomain, RemotePort: t.RemotePort, ResumeToken: t.resumeToken}
+		err = ctrl.Send(&tunnel.Message{Type: tunnel.MsgTunnelRequest, TunnelRequest: req})
+		if err != nil {
+			return fmt.Errorf("failed to send tunnel request: %w", err)
+		}
 
+		msg, err := c.expect(ctrl, tunnel.MsgTunnelAssigned)
+		if err != nil {
+			// after a network blip the server may not have noticed that our previous
+			// session is gone, so a taken subdomain is only fatal on the first connect
+			var serverErr *tunnel.Error
+			if !c.online || !errors.As(err, &serverErr) || serverErr.Code != tunnel.ErrSubdomainTaken {
+				exitOnServerError(err)
+			}
+			return fmt.Errorf("failed to read response from server: %w", err)
 		}
-		c.logger.LogInfoMessage().Msgf("Tunnel is live at: %s", response)
+		t.publicAddr = msg.TunnelAssigned.PublicAddr
+		t.resumeToken = msg.TunnelAssigned.ResumeToken
+		routes[msg.TunnelAssigned.TunnelID] = t
+		c.logger.LogInfoMessage().Msgf("Tunnel is live at: %s", t.publicURL())
 	}
 
+	c.mutex.Lock()
+	c.routes = routes
+	c.online = true
+	c.plan = cs.auth.Plan
+	c.status = "Online"
+	c.reconnectAfter = 0
+	c.mutex.Unlock()
+	c.printStatus()
+
+	go c.watchControl(ctrl, session)
+
 	for {
 		proxyStream, err := session.AcceptStream()
 		if err != nil {
 			return err
 		}
-		go c.handleProxyStream(proxyStream, c.controlMsg.Type)
+		go c.handleProxyStream(proxyStream)
 	}
 }
 
-func (c *Client) handleProxyStream(proxyStream net.Conn, tunnelType string) {
-	defer proxyStream.Close()
-	c.logger.LogInfoMessage().Msgf("Accepted new %s stream from server", tunnelType)
-	// if c.logLevel == zerolog.Disabled {
-	// 	fmt.Printf("Incoming: \t %s (%s %s)\n", originalIP, req.Method, req.URL.Path)
-	// }
-	addr := fmt.Sprintf("localhost:%d", c.localPort)
-	localServiceConn, err := net.Dial("tcp", addr)
-	if err != nil {
-		// Fallback to IPv6 loopback if IPv4 fails
-		addrV6 := fmt.Sprintf("[::1]:%d", c.localPort)
-		localServiceConn, err = net.Dial("tcp", addrV6)
+// ParseAllowList parses IP addresses and CIDR ranges for Tunnel.AllowFrom.
+func ParseAllowList(specs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		if !strings.Contains(spec, "/") {
+			ip := net.ParseIP(spec)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", spec)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR range %q", spec)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// allows reports whether a visitor from ip may use the tunnel.
+func (t *Tunnel) allows(ip net.IP) bool {
+	if len(t.AllowFrom) == 0 {
+		return true
+	}
+	for _, ipNet := range t.AllowFrom {
+		if ip != nil && ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *Tunnel) publicURL() string {
+	if t.Type == "http" {
+		return fmt.Sprintf("https://%s", t.publicAddr)
+	}
+	return fmt.Sprintf("tcp://%s", t.publicAddr)
+}
+
+func (t *Tunnel) localURL() string {
+	return fmt.Sprintf("%s://localhost:%d", t.Type, t.LocalPort)
+}
+
+// retryDelay is how long Start waits before reconnecting.
+func (c *Client) retryDelay() time.Duration {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	if c.reconnectAfter > 0 {
+		return c.reconnectAfter
+	}
+	return 5 * time.Second
+}
+
+// watchControl reads control messages after the tunnel is assigned and tears the
+// session down when the server closes it.
+func (c *Client) watchControl(ctrl *tunnel.ControlConn, session mux.Session) {
+	defer session.Close()
+	for {
+		msg, err := ctrl.Recv()
 		if err != nil {
-			c.logger.LogErrorMessage().Err(err).Msgf("Failed to connect to local service on %s or %s", addr, addrV6)
-			if tunnelType == "http" {
-				resp := &http.Response{
-					StatusCode: http.StatusBadGateway,
-					Body:       io.NopCloser(strings.NewReader("Local service unavailable")),
-				}
-				resp.Write(proxyStream)
+			return
+		}
+		if !msg.Valid() {
+			c.logger.LogWarnMessage().Msgf("Ignoring %s message without payload from server", msg.Type)
+			continue
+		}
+		switch msg.Type {
+		case tunnel.MsgGoAway:
+			// keep serving in-flight streams, the server closes the session once they are done
+			c.goingAway(msg.GoAway)
+		case tunnel.MsgClose:
+			if msg.Close != nil && msg.Close.Reason != "" {
+				c.logger.LogWarnMessage().Msgf("Server closed the tunnel: %s", msg.Close.Reason)
 			}
 			return
+		case tunnel.MsgError:
+			c.logger.LogErrorMessage().Err(msg.Error).Msg("Server reported an error")
+			if msg.Error.Code == tunnel.ErrAccessDenied || msg.Error.Code == tunnel.ErrAuthFailed {
+				// the server's policy changed or our token was revoked while we were connected
+				exitOnServerError(msg.Error)
+			}
 		}
 	}
+}
 
-	defer localServiceConn.Close()
+// goingAway records when to reconnect to a server that is shutting down.
+func (c *Client) goingAway(g *tunnel.GoAway) {
+	hint := time.Duration(g.ReconnectAfterMs) * time.Millisecond
+	c.logger.LogWarnMessage().Msgf("Server is going away (%s), reconnecting in %s once drained", g.Reason, hint)
+	c.mutex.Lock()
+	c.status = fmt.Sprintf("Draining (%s)", g.Reason)
+	c.reconnectAfter = hint
+	c.mutex.Unlock()
+	c.printStatus()
+}
 
-	switch tunnelType {
-	case "http":
-		req, err := http.ReadRequest(bufio.NewReader(proxyStream))
+// expect is ctrl.Expect for the handshake and tunnel requests. A draining server
+// announces itself with a go-away notice before refusing with ErrGoingAway; the
+// notice is recorded for the retry delay and skipped.
+func (c *Client) expect(ctrl *tunnel.ControlConn, t tunnel.MessageType) (*tunnel.Message, error) {
+	for {
+		msg, err := ctrl.Recv()
 		if err != nil {
-			c.logger.LogErrorMessage().Err(err).Msg("Failed to read http request from server")
-			return
+			return nil, err
 		}
-		originalIP := req.Header.Get("X-Forwarded-For")
-		if originalIP == "" {
-			originalIP = "unknown"
+		if msg.Type == tunnel.MsgGoAway && t != tunnel.MsgGoAway && msg.Valid() {
+			c.goingAway(msg.GoAway)
+			continue
 		}
+		if err := msg.CheckType(t); err != nil {
+			return nil, err
+		}
+		return msg, nil
+	}
+}
 
-		fmt.Printf("Incoming: \t %s (%s %s)\n", originalIP, req.Method, req.URL.Path)
+// exitOnServerError stops the client when the server rejected the handshake or
+// the tunnel request; retrying would only fail the same way.
+func exitOnServerError(err error) {
+	var serverErr *tunnel.Error
+	if !errors.As(err, &serverErr) {
+		return
+	}
+	switch serverErr.Code {
+	case tunnel.ErrInternal, tunnel.ErrPortUnavailable, tunnel.ErrGoingAway:
+		return
+	}
+	fmt.Println(serverErr.Message)
+	os.Exit(1)
+}
 
-		if err := req.Write(localServiceConn); err != nil {
-			c.logger.LogErrorMessage().Err(err).Msg("Failed to write request to local service")
-			return
+func (c *Client) handleProxyStream(proxyStream net.Conn) {
+	defer proxyStream.Close()
+
+	header, err := tunnel.ReadStreamHeader(proxyStream)
+	if err != nil {
+		c.logger.LogErrorMessage().Err(err).Msg("Failed to read stream header from server")
+		return
+	}
+	c.mutex.RLock()
+	t, ok := c.routes[header.TunnelID]
+	c.mutex.RUnlock()
+	if !ok {
+		c.logger.LogErrorMessage().Msgf("Received stream for unknown tunnel %s", header.TunnelID)
+		return
+	}
+	tunnelType := t.Type
+	visitor := header.VisitorAddr
+	if visitor == "" {
+		visitor = "unknown"
+	}
+
+	c.logger.LogInfoMessage().Str("request_id", header.RequestID).Str("visitor", visitor).
+		Msgf("Accepted new %s stream from server for tunnel %s", tunnelType, header.TunnelID)
+	if !t.allows(header.VisitorIP()) {
+		c.logger.LogWarnMessage().Msgf("Rejected visitor %s on tunnel %s, not in the allow list", visitor, header.TunnelID)
+		c.logIncoming(fmt.Sprintf("%s (%s, blocked)", visitor, tunnelType))
+		if tunnelType == "http" {
+			writeStatus(proxyStream, http.StatusForbidden, "Forbidden")
 		}
+		return
+	}
 
-		io.Copy(proxyStream, localServiceConn)
+	switch tunnelType {
+	case "http":
+		streamReader := bufio.NewReader(proxyStream)
+		req, err := c.readRequest(streamReader, header, visitor)
+		if err != nil {
+			return
+		}
+		c.proxyHTTP(proxyStream, streamReader, req, t)
 
 	case "tcp":
+		localServiceConn, err := t.dialer.DialContext(context.Background(), "tcp", "")
+		if err != nil {
+			c.logger.LogErrorMessage().Err(err).Msgf("Failed to connect to local service on port %d", t.LocalPort)
+			return
+		}
+		defer localServiceConn.Close()
+
+		c.logIncoming(fmt.Sprintf("%s (tcp)", visitor))
 		go func() {
 			io.Copy(localServiceConn, proxyStream)
 		}()
 		io.Copy(proxyStream, localServiceConn)
 	}
 }
+
+// readRequest reads the visitor's request from an http stream and sets the
+// forwarding headers from the stream header.
+func (c *Client) readRequest(streamReader *bufio.Reader, header *tunnel.StreamHeader, visitor string) (*http.Request, error) {
+	req, err := http.ReadRequest(streamReader)
+	if err != nil {
+		c.logger.LogErrorMessage().Err(err).Msg("Failed to read http request from server")
+		return nil, err
+	}
+	// the stream header is authoritative, whatever the visitor put in the request
+	if ip := header.VisitorIP(); ip != nil {
+		req.Header.Set("X-Forwarded-For", ip.String())
+	}
+	req.Header.Set("X-Forwarded-Proto", "http")
+	if header.TLS != nil {
+		req.Header.Set("X-Forwarded-Proto", "https")
+	}
+	if header.RequestID != "" && req.Header.Get("X-Request-Id") == "" {
+		req.Header.Set("X-Request-Id", header.RequestID)
+	}
+
+	c.logIncoming(fmt.Sprintf("%s (%s %s)", visitor, req.Method, req.URL.Path))
+	return req, nil
+}
+
+// writeStatus answers an HTTP stream with a plain-text error response.
+func writeStatus(w io.Writer, code int, text string) {
+	resp := &http.Response{
+		StatusCode: code,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Body:       io.NopCloser(strings.NewReader(text)),
+	}
+	resp.Write(w)
+}
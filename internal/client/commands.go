@@ -0,0 +1,84 @@
+package client
+
+import (
+	"fmt"
+
+	"github.com/harsh082ip/ZapTun/pkg/tunnel"
+)
+
+// command runs a single request/response exchange on a fresh control session.
+func (c *Client) command(req *tunnel.Message, want tunnel.MessageType) (*tunnel.Message, error) {
+	cs, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer cs.Close()
+
+	if err := cs.ctrl.Send(req); err != nil {
+		return nil, fmt.Errorf("failed to send %s: %w", req.Type, err)
+	}
+	resp, err := cs.ctrl.Expect(want)
+	cs.ctrl.Send(&tunnel.Message{Type: tunnel.MsgClose, Close: &tunnel.Close{Reason: "command finished"}})
+	return resp, err
+}
+
+// Reserve reserves a subdomain or, for tunnel.ReservationTCPPort, the next free
+// public port for the authenticated user.
+func (c *Client) Reserve(kind, name string) (*tunnel.Reservation, error) {
+	resp, err := c.command(&tunnel.Message{
+		Type:        tunnel.MsgReserve,
+		Reservation: &tunnel.Reservation{Kind: kind, Name: name},
+	}, tunnel.MsgReservations)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Reservations) == 0 {
+		return nil, fmt.Errorf("server returned no reservation")
+	}
+	return &resp.Reservations[0], nil
+}
+
+// Release gives a reserved subdomain or port back.
+func (c *Client) Release(kind, name string, port int) error {
+	_, err := c.command(&tunnel.Message{
+		Type:        tunnel.MsgRelease,
+		Reservation: &tunnel.Reservation{Kind: kind, Name: name, Port: port},
+	}, tunnel.MsgReservations)
+	return err
+}
+
+// Reservations lists everything the authenticated user has reserved.
+func (c *Client) Reservations() ([]tunnel.Reservation, error) {
+	resp, err := c.command(&tunnel.Message{Type: tunnel.MsgListReservations}, tunnel.MsgReservations)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Reservations, nil
+}
+
+// Tokens lists the machine tokens of the authenticated user.
+func (c *Client) Tokens() ([]tunnel.TokenInfo, error) {
+	resp, err := c.command(&tunnel.Message{Type: tunnel.MsgListTokens}, tunnel.MsgTokens)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Tokens, nil
+}
+
+// RenameToken gives the machine token id a new name.
+func (c *Client) RenameToken(id, name string) error {
+	_, err := c.command(&tunnel.Message{
+		Type:  tunnel.MsgRenameToken,
+		Token: &tunnel.TokenInfo{ID: id, Name: name},
+	}, tunnel.MsgTokens)
+	return err
+}
+
+// RevokeToken revokes the machine token id. Sessions using it are disconnected.
+func (c *Client) RevokeToken(id string) error {
+	_, err := c.command(&tunnel.Message{
+		Type:  tunnel.MsgRevokeToken,
+		Token: &tunnel.TokenInfo{ID: id},
+	}, tunnel.MsgTokens)
+	return err
+}
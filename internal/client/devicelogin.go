@@ -0,0 +1,95 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// DeviceCode is what the website hands out when a device login starts. The user
+// enters UserCode at VerificationURI (or just opens VerificationURIComplete).
+type DeviceCode struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval"`
+}
+
+var (
+	ErrLoginExpired = errors.New("the login code expired before it was approved")
+	ErrLoginDenied  = errors.New("the login was denied in the browser")
+)
+
+// DeviceLogin runs the device-code login against the website at websiteURL: it
+// requests a code, passes it to prompt for display and polls until the user has
+// approved it in the browser. It returns the auth token.
+func DeviceLogin(websiteURL string, prompt func(code *DeviceCode)) (string, error) {
+	resp, err := http.PostForm(websiteURL+"/device/code", nil)
+	if err != nil {
+		return "", fmt.Errorf("error requesting login code: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return "", errors.New("too many login codes requested from this address, try again later")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("error requesting login code: http %d", resp.StatusCode)
+	}
+	var code DeviceCode
+	if err := json.NewDecoder(resp.Body).Decode(&code); err != nil {
+		return "", fmt.Errorf("error decoding login code: %v", err)
+	}
+	prompt(&code)
+
+	interval := time.Duration(code.Interval) * time.Second
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	deadline := time.Now().Add(time.Duration(code.ExpiresIn) * time.Second)
+	for time.Now().Before(deadline) {
+		time.Sleep(interval)
+		token, errCode, err := pollDeviceToken(websiteURL, code.DeviceCode)
+		if err != nil {
+			return "", err
+		}
+		switch errCode {
+		case "":
+			return token, nil
+		case "authorization_pending":
+		case "slow_down":
+			interval += 5 * time.Second
+		case "expired_token":
+			return "", ErrLoginExpired
+		case "access_denied":
+			return "", ErrLoginDenied
+		default:
+			return "", fmt.Errorf("login failed: %s", errCode)
+		}
+	}
+	return "", ErrLoginExpired
+}
+
+// pollDeviceToken asks once for the token. errCode is set while the login is not done.
+func pollDeviceToken(websiteURL, deviceCode string) (token, errCode string, err error) {
+	resp, err := http.PostForm(websiteURL+"/device/token", url.Values{"device_code": {deviceCode}})
+	if err != nil {
+		return "", "", fmt.Errorf("error polling for token: %v", err)
+	}
+	defer resp.Body.Close()
+	var answer struct {
+		AccessToken string `json:"access_token"`
+		Error       string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&answer); err != nil {
+		return "", "", fmt.Errorf("error polling for token: http %d", resp.StatusCode)
+	}
+	if answer.Error == "" && answer.AccessToken == "" {
+		return "", "", fmt.Errorf("error polling for token: empty answer")
+	}
+	return answer.AccessToken, answer.Error, nil
+}
@@ -0,0 +1,83 @@
+package client
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/harsh082ip/ZapTun/pkg/tunnel"
+	"github.com/rs/zerolog"
+)
+
+// maxRecentRequests is how many incoming requests the status screen keeps.
+const maxRecentRequests = 10
+
+// printStatus redraws the interactive status screen. It is a no-op when logging
+// is enabled, since the log lines already carry the same information.
+func (c *Client) printStatus() {
+	if c.logLevel != zerolog.Disabled {
+		return
+	}
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	fmt.Print("\033[H\033[2J") // clear
+	fmt.Printf("Status: \t %s \n", c.status)
+	if c.plan != nil {
+		fmt.Printf("Plan: \t\t %s \n", describePlan(c.plan))
+	}
+	if c.latency > 0 {
+		fmt.Printf("Latency: \t %s \n", c.latency.Round(time.Millisecond))
+	}
+	for _, t := range c.tunnels {
+		fmt.Printf("Forwarding: \t %s -> %s \n", t.publicURL(), t.localURL())
+	}
+	if len(c.recent) > 0 {
+		fmt.Println()
+	}
+	for _, line := range c.recent {
+		fmt.Printf("Incoming: \t %s\n", line)
+	}
+}
+
+// setLatency records the control stream RTT and refreshes the status screen.
+func (c *Client) setLatency(rtt time.Duration) {
+	c.mutex.Lock()
+	c.latency = rtt
+	c.mutex.Unlock()
+	c.logger.LogDebugMessage().Msgf("Heartbeat RTT: %s", rtt)
+	c.printStatus()
+}
+
+// logIncoming prints an incoming request and remembers it for status redraws.
+func (c *Client) logIncoming(line string) {
+	c.mutex.Lock()
+	c.recent = append(c.recent, line)
+	if len(c.recent) > maxRecentRequests {
+		c.recent = c.recent[len(c.recent)-maxRecentRequests:]
+	}
+	c.mutex.Unlock()
+	fmt.Printf("Incoming: \t %s\n", line)
+}
+
+// describePlan summarizes the limits of plan in one line.
+func describePlan(plan *tunnel.Plan) string {
+	limit := func(n int64, unit string) string {
+		if n <= 0 {
+			return "unlimited " + unit
+		}
+		return fmt.Sprintf("%d %s", n, unit)
+	}
+	parts := []string{
+		limit(int64(plan.MaxHTTPTunnels), "HTTP tunnels"),
+		limit(int64(plan.MaxTCPTunnels), "TCP tunnels"),
+		limit(int64(plan.MaxStreams), "concurrent streams"),
+	}
+	if plan.BandwidthBytesPerSec > 0 {
+		parts = append(parts, fmt.Sprintf("%d KB/s", plan.BandwidthBytesPerSec/1024))
+	}
+	if !plan.CustomSubdomains {
+		parts = append(parts, "no custom subdomains")
+	}
+	return fmt.Sprintf("%s (%s)", plan.Name, strings.Join(parts, ", "))
+}
@@ -0,0 +1,256 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/harsh082ip/ZapTun/config"
+	"github.com/harsh082ip/ZapTun/pkg/tunnel"
+)
+
+// Protocols spoken to the local service of an http tunnel, set in Tunnel.Upstream.
+// Without one the request is relayed as HTTP/1.1.
+const (
+	UpstreamH2C = "h2c" // HTTP/2 without TLS (prior knowledge), as gRPC servers speak
+	UpstreamH2  = "h2"  // HTTP/2 over TLS; the local certificate is not verified
+)
+
+const (
+	defaultMaxIdleConns    = 64
+	defaultIdleConnTimeout = 90 * time.Second
+	localDialTimeout       = 5 * time.Second
+)
+
+// localDialer connects to a port on the loopback interface. Services listen on
+// IPv4, IPv6 or both, so it tries both and starts with the one that answered last.
+type localDialer struct {
+	addrs     []string
+	preferred atomic.Int32 // index into addrs
+	dialer    net.Dialer
+}
+
+func newLocalDialer(port int) *localDialer {
+	return &localDialer{
+		addrs:  []string{fmt.Sprintf("127.0.0.1:%d", port), fmt.Sprintf("[::1]:%d", port)},
+		dialer: net.Dialer{Timeout: localDialTimeout, KeepAlive: 30 * time.Second},
+	}
+}
+
+// DialContext connects to the local port; network and addr are ignored, which
+// lets it serve as the dialer of an http.Transport.
+func (d *localDialer) DialContext(ctx context.Context, _, _ string) (net.Conn, error) {
+	first := int(d.preferred.Load())
+	var errs []error
+	for i := range d.addrs {
+		idx := (first + i) % len(d.addrs)
+		conn, err := d.dialer.DialContext(ctx, "tcp", d.addrs[idx])
+		if err == nil {
+			d.preferred.Store(int32(idx))
+			return conn, nil
+		}
+		errs = append(errs, err)
+	}
+	return nil, errors.Join(errs...)
+}
+
+// newLocalTransport returns the transport for requests to the local service of an
+// http tunnel, speaking upstream. It keeps connections alive between requests, up
+// to conf.MaxIdleConns idle ones for conf.IdleConnTimeout.
+func newLocalTransport(upstream string, dialer *localDialer, conf *config.ClientConfig) (*http.Transport, error) {
+	maxIdle, idleTimeout := defaultMaxIdleConns, defaultIdleConnTimeout
+	if conf.MaxIdleConns > 0 {
+		maxIdle = conf.MaxIdleConns
+	}
+	if conf.IdleConnTimeout > 0 {
+		idleTimeout = conf.IdleConnTimeout
+	}
+	protocols := new(http.Protocols)
+	transport := &http.Transport{
+		DialContext:         dialer.DialContext,
+		Protocols:           protocols,
+		MaxIdleConns:        maxIdle,
+		MaxIdleConnsPerHost: maxIdle,
+		IdleConnTimeout:     idleTimeout,
+		DisableCompression:  true, // pass encodings through as the visitor asked for them
+	}
+	switch upstream {
+	case "":
+		protocols.SetHTTP1(true)
+	case UpstreamH2C:
+		protocols.SetUnencryptedHTTP2(true)
+	case UpstreamH2:
+		protocols.SetHTTP2(true)
+		// the service runs on this machine, usually with a self-signed certificate
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	default:
+		return nil, fmt.Errorf("unknown upstream protocol %q, want %s or %s", upstream, UpstreamH2C, UpstreamH2)
+	}
+	return transport, nil
+}
+
+// proxyHTTP relays the HTTP request on stream to the local service over a pooled
+// connection and writes the response back as HTTP/1.1. Bodies are streamed in
+// both directions at once, which gRPC bidirectional streams rely on, and
+// trailers such as grpc-status are kept. After a protocol switch, e.g. to
+// WebSocket, raw bytes are relayed both ways.
+func (c *Client) proxyHTTP(stream net.Conn, streamReader *bufio.Reader, req *http.Request, t *Tunnel) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// the server closes the stream once the visitor went away; that can only be
+	// seen after the request body, so the exchange is cancelled then
+	watchClose := sync.OnceFunc(func() {
+		go func() {
+			io.Copy(io.Discard, streamReader)
+			cancel()
+		}()
+	})
+	// after a protocol switch the stream carries the visitor's bytes instead
+	upgrade := tunnel.IsUpgrade(req.Header)
+	switch {
+	case req.Body != nil && req.Body != http.NoBody:
+		req.Body = &eofNotifier{ReadCloser: req.Body, onEOF: watchClose}
+	case !upgrade:
+		watchClose()
+	}
+
+	scheme := "http"
+	if t.Upstream == UpstreamH2 {
+		scheme = "https"
+	}
+	req.URL.Scheme, req.URL.Host = scheme, fmt.Sprintf("localhost:%d", t.LocalPort)
+	req.RequestURI = ""
+	req.Close = false // the visitor's connection, not the pooled one
+	upgradeTo := req.Header.Get("Upgrade")
+	for _, key := range tunnel.HopHeaders {
+		req.Header.Del(key)
+	}
+	if upgrade {
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", upgradeTo)
+	}
+	// HTTP/2 only allows TE: trailers, which gRPC servers insist on
+	if te := req.Header.Get("Te"); te != "" && t.Upstream != "" {
+		req.Header.Del("Te")
+		if strings.Contains(strings.ToLower(te), "trailers") {
+			req.Header.Set("Te", "trailers")
+		}
+	}
+
+	resp, err := t.transport.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		if ctx.Err() == nil {
+			c.logger.LogErrorMessage().Err(err).Msgf("Failed to reach local service on port %d", t.LocalPort)
+			writeStatus(stream, http.StatusBadGateway, "Local service unavailable")
+		}
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		c.relayUpgrade(stream, streamReader, resp)
+		return
+	}
+	if upgrade {
+		watchClose()
+	}
+	if err := writeResponse(stream, resp); err != nil && ctx.Err() == nil {
+		c.logger.LogErrorMessage().Err(err).Msgf("Failed to relay response of local service on port %d", t.LocalPort)
+	}
+}
+
+// relayUpgrade passes a 101 response on and then relays raw bytes between the
+// stream and the switched connection until either side closes.
+func (c *Client) relayUpgrade(stream net.Conn, streamReader *bufio.Reader, resp *http.Response) {
+	conn, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		c.logger.LogErrorMessage().Msg("Local service switched protocols on a connection that cannot be taken over")
+		return
+	}
+	if err := writeResponseHeader(stream, resp.StatusCode, resp.Header); err != nil {
+		return
+	}
+	go func() {
+		defer conn.Close()
+		io.Copy(conn, streamReader)
+	}()
+	io.Copy(stream, conn)
+}
+
+// writeResponse writes resp to w as HTTP/1.1. Bodies of unknown length and
+// bodies with trailers are sent chunked, every chunk as it arrives, finishing
+// with the trailers of resp.
+func writeResponse(w io.Writer, resp *http.Response) error {
+	header := resp.Header.Clone()
+	for _, key := range tunnel.HopHeaders {
+		header.Del(key)
+	}
+	header.Del("Trailer")
+
+	bodyless := resp.Request.Method == http.MethodHead || resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified
+	chunked := !bodyless && (resp.ContentLength < 0 || len(resp.Trailer) > 0)
+	switch {
+	case chunked:
+		header.Del("Content-Length")
+		header.Set("Transfer-Encoding", "chunked")
+		for key := range resp.Trailer {
+			header.Add("Trailer", key)
+		}
+	case !bodyless:
+		header.Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+	}
+	if err := writeResponseHeader(w, resp.StatusCode, header); err != nil || bodyless {
+		return err
+	}
+	if !chunked {
+		_, err := io.Copy(w, resp.Body)
+		return err
+	}
+
+	cw := httputil.NewChunkedWriter(w)
+	if _, err := io.Copy(cw, resp.Body); err != nil {
+		return err
+	}
+	if err := cw.Close(); err != nil {
+		return err
+	}
+	// trailers are only complete once the body was read
+	bw := bufio.NewWriter(w)
+	resp.Trailer.Write(bw)
+	bw.WriteString("\r\n")
+	return bw.Flush()
+}
+
+// writeResponseHeader writes an HTTP/1.1 status line and header.
+func writeResponseHeader(w io.Writer, code int, header http.Header) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "HTTP/1.1 %03d %s\r\n", code, http.StatusText(code))
+	header.Write(bw)
+	bw.WriteString("\r\n")
+	return bw.Flush()
+}
+
+// eofNotifier calls onEOF once the wrapped body is fully read.
+type eofNotifier struct {
+	io.ReadCloser
+	onEOF func()
+}
+
+func (r *eofNotifier) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if err == io.EOF {
+		r.onEOF()
+	}
+	return n, err
+}
@@ -0,0 +1,106 @@
+// Package mux abstracts the stream multiplexer that carries the control stream and
+// all proxied streams over a single client connection. Implementations register
+// themselves under a name; client and server agree on one during the TLS handshake
+// via ALPN, so the choice is made before the first byte of the control protocol.
+package mux
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+)
+
+// alpnPrefix namespaces multiplexer names in the TLS ALPN extension.
+const alpnPrefix = "zaptun-"
+
+// Default is used when the peer does not negotiate a multiplexer, i.e. clients and
+// servers built before multiplexers were pluggable.
+const Default = "yamux"
+
+// Session is a multiplexed connection carrying many bidirectional streams.
+type Session interface {
+	// OpenStream opens a new stream to the peer.
+	OpenStream() (net.Conn, error)
+	// AcceptStream waits for the next stream opened by the peer.
+	AcceptStream() (net.Conn, error)
+	// NumStreams returns the number of currently open streams.
+	NumStreams() int
+	// IsClosed reports whether the session has been closed.
+	IsClosed() bool
+	// Close closes the session, its streams and the underlying connection.
+	Close() error
+}
+
+// Mux creates sessions on top of an established connection.
+type Mux interface {
+	Name() string
+	Client(conn net.Conn) (Session, error)
+	Server(conn net.Conn) (Session, error)
+}
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[string]Mux{}
+	order      []string
+)
+
+// Register makes m available under m.Name(). Registration order is the default
+// preference order.
+func Register(m Mux) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if _, dup := registry[m.Name()]; dup {
+		panic(fmt.Sprintf("mux: %s registered twice", m.Name()))
+	}
+	registry[m.Name()] = m
+	order = append(order, m.Name())
+}
+
+// Get returns the multiplexer registered under name.
+func Get(name string) (Mux, error) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	m, ok := registry[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown multiplexer %q", name)
+	}
+	return m, nil
+}
+
+// Names returns all registered multiplexers in preference order.
+func Names() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	return append([]string(nil), order...)
+}
+
+// ALPN returns the TLS application protocols announcing names, in the same order.
+func ALPN(names []string) []string {
+	protos := make([]string, len(names))
+	for i, name := range names {
+		protos[i] = alpnPrefix + name
+	}
+	return protos
+}
+
+// Negotiated returns the multiplexer selected by a TLS handshake, given the
+// negotiated application protocol and the multiplexers enabled on this side. An
+// empty protocol means the peer predates negotiation and gets Default, unless
+// Default is not enabled.
+func Negotiated(proto string, enabled []string) (Mux, error) {
+	name := Default
+	if proto != "" {
+		if len(proto) <= len(alpnPrefix) || proto[:len(alpnPrefix)] != alpnPrefix {
+			return nil, fmt.Errorf("unexpected application protocol %q", proto)
+		}
+		name = proto[len(alpnPrefix):]
+	}
+	if !slices.Contains(enabled, name) {
+		if proto == "" {
+			return nil, fmt.Errorf("peer negotiated no multiplexer and %s is not enabled", Default)
+		}
+		return nil, fmt.Errorf("multiplexer %s is not enabled", name)
+	}
+	return Get(name)
+}
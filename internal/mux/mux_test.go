@@ -0,0 +1,27 @@
+package mux
+
+import "testing"
+
+func TestNegotiated(t *testing.T) {
+	registered := Names()
+	for _, tc := range []struct {
+		name    string
+		proto   string
+		enabled []string
+		want    string // empty when the connection is refused
+	}{
+		{"legacy peer", "", registered, Default},
+		{"legacy peer without the default", "", []string{"yamux-tuned"}, ""},
+		{"negotiated", "zaptun-yamux-tuned", registered, "yamux-tuned"},
+		{"negotiated but not enabled", "zaptun-yamux-tuned", []string{Default}, ""},
+		{"foreign protocol", "h2", registered, ""},
+	} {
+		m, err := Negotiated(tc.proto, tc.enabled)
+		switch {
+		case tc.want == "" && err == nil:
+			t.Errorf("%s: got %s, want an error", tc.name, m.Name())
+		case tc.want != "" && (err != nil || m.Name() != tc.want):
+			t.Errorf("%s: got %v, %v, want %s", tc.name, m, err, tc.want)
+		}
+	}
+}
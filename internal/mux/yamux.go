@@ -0,0 +1,66 @@
+package mux
+
+import (
+	"net"
+
+	"github.com/hashicorp/yamux"
+)
+
+func init() {
+	Register(&yamuxMux{name: "yamux", config: defaultYamuxConfig})
+	Register(&yamuxMux{name: "yamux-tuned", config: tunedYamuxConfig})
+}
+
+// defaultYamuxConfig is the configuration zaptun has always used. Keep-alives are
+// off because the control protocol has its own heartbeats.
+func defaultYamuxConfig() *yamux.Config {
+	config := yamux.DefaultConfig()
+	config.EnableKeepAlive = false
+	return config
+}
+
+// tunedYamuxConfig trades memory for throughput: larger per-stream windows let a
+// single download use more of the link before waiting for window updates, and a
+// deeper accept backlog absorbs bursts of new visitors.
+func tunedYamuxConfig() *yamux.Config {
+	config := defaultYamuxConfig()
+	config.AcceptBacklog = 1024
+	config.MaxStreamWindowSize = 1 << 20
+	return config
+}
+
+type yamuxMux struct {
+	name   string
+	config func() *yamux.Config
+}
+
+func (m *yamuxMux) Name() string { return m.name }
+
+func (m *yamuxMux) Client(conn net.Conn) (Session, error) {
+	session, err := yamux.Client(conn, m.config())
+	if err != nil {
+		return nil, err
+	}
+	return &yamuxSession{session}, nil
+}
+
+func (m *yamuxMux) Server(conn net.Conn) (Session, error) {
+	session, err := yamux.Server(conn, m.config())
+	if err != nil {
+		return nil, err
+	}
+	return &yamuxSession{session}, nil
+}
+
+// yamuxSession adapts *yamux.Session, whose stream methods return *yamux.Stream.
+type yamuxSession struct {
+	*yamux.Session
+}
+
+func (s *yamuxSession) OpenStream() (net.Conn, error) {
+	return s.Session.OpenStream()
+}
+
+func (s *yamuxSession) AcceptStream() (net.Conn, error) {
+	return s.Session.AcceptStream()
+}
@@ -0,0 +1,180 @@
+// Package apikey authenticates clients with API keys managed by the server operator,
+// for deployments that cannot or do not want to reach GitHub. Keys are read from a
+// JSON file or from the KV store and are only ever compared by their SHA-256 hash.
+package apikey
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/harsh082ip/ZapTun/internal/server/github"
+	"github.com/harsh082ip/ZapTun/pkg/db/redis"
+)
+
+const (
+	keyPrefix   = "ztk_"
+	kvKeyPrefix = "zaptun:apikey"
+	kvRetries   = 2
+)
+
+// Key describes who an API key belongs to.
+type Key struct {
+	Login      string    `json:"login"`
+	Name       string    `json:"name,omitempty"`
+	MaxTunnels int       `json:"max_tunnels,omitempty"` // when set, overrides the plan's HTTP and TCP tunnel limits
+	Plan       string    `json:"plan,omitempty"`        // when set, overrides the server's plan assignment
+	CreatedAt  time.Time `json:"created_at,omitempty"`
+}
+
+// Generate returns a new random API key.
+func Generate() string {
+	b := make([]byte, 24)
+	rand.Read(b)
+	return keyPrefix + hex.EncodeToString(b)
+}
+
+// Hash returns the hex SHA-256 of key, the form keys are stored and looked up in.
+func Hash(key string) string {
+	sum := sha256.Sum256([]byte(strings.TrimSpace(key)))
+	return hex.EncodeToString(sum[:])
+}
+
+func (k Key) user() github.User {
+	return github.User{
+		Name:       k.Name,
+		Login:      strings.ToLower(k.Login),
+		Allowed:    true,
+		MaxTunnels: k.MaxTunnels,
+		Plan:       k.Plan,
+	}
+}
+
+// errNoOAuth is returned by the OAuth half of github.Authenticator, which API keys
+// have no use for.
+var errNoOAuth = fmt.Errorf("api keys do not support the oauth flow")
+
+// fileAuthenticator serves keys loaded once from a JSON file.
+type fileAuthenticator struct {
+	keys map[string]Key // hash -> key
+}
+
+// fileEntry is one element of the keys file. Either the plain key or its
+// key_sha256 must be set; the hash keeps secrets out of the file.
+type fileEntry struct {
+	Key
+	Secret    string `json:"key"`
+	KeySHA256 string `json:"key_sha256"`
+}
+
+// NewFile loads API keys from a JSON file holding an array of entries like
+// {"key_sha256": "...", "login": "alice", "max_tunnels": 5}.
+func NewFile(path string) (github.Authenticator, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read api keys file: %v", err)
+	}
+	var entries []fileEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("failed to parse api keys file %s: %v", path, err)
+	}
+	keys := make(map[string]Key, len(entries))
+	for i, e := range entries {
+		hash := strings.ToLower(e.KeySHA256)
+		if hash == "" && e.Secret != "" {
+			hash = Hash(e.Secret)
+		}
+		if hash == "" || e.Login == "" {
+			return nil, fmt.Errorf("api keys file %s: entry %d needs a key or key_sha256 and a login", path, i)
+		}
+		keys[hash] = e.Key
+	}
+	return &fileAuthenticator{keys: keys}, nil
+}
+
+func (a *fileAuthenticator) GetOAuthUrl(string) string { return "" }
+
+func (a *fileAuthenticator) ExchangeCodeForToken(code string) (string, error) {
+	return "", errNoOAuth
+}
+
+func (a *fileAuthenticator) Authenticate(token string) (github.User, error) {
+	key, ok := a.keys[Hash(token)]
+	if !ok {
+		return github.User{}, fmt.Errorf("unknown api key: %w", github.ErrInvalidToken)
+	}
+	return key.user(), nil
+}
+
+// kvAuthenticator looks keys up in the KV store on every authentication, so keys
+// created or deleted with the zaptun-server apikey command apply immediately.
+type kvAuthenticator struct {
+	kv redis.RedisStoreWithRetries
+}
+
+// NewKV returns an authenticator backed by keys stored in kv.
+func NewKV(kv redis.RedisStoreWithRetries) github.Authenticator {
+	return &kvAuthenticator{kv: kv}
+}
+
+func kvKey(hash string) string {
+	return fmt.Sprintf("%s:%s", kvKeyPrefix, hash)
+}
+
+func (a *kvAuthenticator) GetOAuthUrl(string) string { return "" }
+
+func (a *kvAuthenticator) ExchangeCodeForToken(code string) (string, error) {
+	return "", errNoOAuth
+}
+
+func (a *kvAuthenticator) Authenticate(token string) (github.User, error) {
+	key := kvKey(Hash(token))
+	exists, err := a.kv.ExistsWithMaxRetries(key, kvRetries)
+	if err != nil {
+		return github.User{}, fmt.Errorf("failed to look up api key: %v", err)
+	}
+	if !exists {
+		return github.User{}, fmt.Errorf("unknown api key: %w", github.ErrInvalidToken)
+	}
+	var k Key
+	if err := a.kv.GetJSONWithMaxRetries(key, &k, kvRetries); err != nil {
+		return github.User{}, fmt.Errorf("failed to look up api key: %v", err)
+	}
+	return k.user(), nil
+}
+
+// Create stores a new API key for k.Login in kv and returns it. The key itself is
+// not stored, so this is the only time it can be shown.
+func Create(kv redis.RedisStoreWithRetries, k Key) (string, error) {
+	if k.Login == "" {
+		return "", fmt.Errorf("login is required")
+	}
+	token := Generate()
+	k.CreatedAt = time.Now().UTC()
+	if err := kv.SetJSONWithMaxRetries(kvKey(Hash(token)), k, 0, kvRetries); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Delete removes an API key from kv, given either the key or its hash.
+func Delete(kv redis.RedisStoreWithRetries, keyOrHash string) error {
+	hash := strings.ToLower(keyOrHash)
+	if strings.HasPrefix(keyOrHash, keyPrefix) {
+		hash = Hash(keyOrHash)
+	}
+	key := kvKey(hash)
+	exists, err := kv.ExistsWithMaxRetries(key, kvRetries)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("no such api key")
+	}
+	return kv.DelWithMaxRetries(key, kvRetries)
+}
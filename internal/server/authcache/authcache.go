@@ -0,0 +1,119 @@
+// Package authcache remembers the result of token validation, so reconnecting
+// clients do not hit the identity provider on every connect and keep working
+// through short provider outages.
+package authcache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/harsh082ip/ZapTun/internal/server/github"
+	"github.com/harsh082ip/ZapTun/pkg/db/redis"
+	log "github.com/harsh082ip/ZapTun/pkg/logger"
+)
+
+const (
+	keyPrefix = "zaptun:authcache"
+	retries   = 2
+
+	DefaultTTL         = 5 * time.Minute
+	DefaultNegativeTTL = 30 * time.Second
+	DefaultStaleTTL    = time.Hour
+)
+
+// Options controls how long results are cached.
+type Options struct {
+	// TTL is how long a successful validation is trusted without asking again.
+	TTL time.Duration
+	// NegativeTTL is how long a rejected token is rejected without asking again.
+	NegativeTTL time.Duration
+	// StaleTTL is how long past TTL a successful validation is still used when the
+	// identity provider cannot be reached.
+	StaleTTL time.Duration
+}
+
+// entry is what is stored per token. MaxTunnels and Plan are kept separately
+// because github.User does not serialize them.
+type entry struct {
+	User       github.User `json:"user"`
+	MaxTunnels int         `json:"max_tunnels,omitempty"`
+	Plan       string      `json:"plan,omitempty"`
+	Invalid    bool        `json:"invalid,omitempty"`
+	CheckedAt  time.Time   `json:"checked_at"`
+}
+
+type cached struct {
+	github.Authenticator
+	kv     redis.RedisStoreWithRetries
+	opts   Options
+	logger *log.Logger
+}
+
+// New wraps inner with a cache kept in kv, which may be the redis client or the
+// in-memory store. Zero options fall back to the defaults.
+func New(inner github.Authenticator, kv redis.RedisStoreWithRetries, opts Options, logger *log.Logger) github.Authenticator {
+	if opts.TTL <= 0 {
+		opts.TTL = DefaultTTL
+	}
+	if opts.NegativeTTL <= 0 {
+		opts.NegativeTTL = DefaultNegativeTTL
+	}
+	if opts.StaleTTL <= 0 {
+		opts.StaleTTL = DefaultStaleTTL
+	}
+	return &cached{Authenticator: inner, kv: kv, opts: opts, logger: logger}
+}
+
+// cacheKey never contains the token itself.
+func cacheKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return fmt.Sprintf("%s:%s", keyPrefix, hex.EncodeToString(sum[:]))
+}
+
+func (c *cached) Authenticate(token string) (github.User, error) {
+	key := cacheKey(token)
+	var e entry
+	hit := c.kv.GetJSONWithMaxRetries(key, &e, retries) == nil
+
+	if hit {
+		age := time.Since(e.CheckedAt)
+		if e.Invalid && age < c.opts.NegativeTTL {
+			return github.User{}, fmt.Errorf("cached: %w", github.ErrInvalidToken)
+		}
+		if !e.Invalid && age < c.opts.TTL {
+			return e.user(), nil
+		}
+	}
+
+	user, err := c.Authenticator.Authenticate(token)
+	switch {
+	case err == nil:
+		c.store(key, entry{User: user, MaxTunnels: user.MaxTunnels, Plan: user.Plan, CheckedAt: time.Now()}, c.opts.TTL+c.opts.StaleTTL)
+		return user, nil
+	case errors.Is(err, github.ErrInvalidToken):
+		c.store(key, entry{Invalid: true, CheckedAt: time.Now()}, c.opts.NegativeTTL)
+		return user, err
+	case hit && !e.Invalid:
+		// the provider is unreachable or failing, keep admitting users it vouched for recently
+		c.logger.LogWarnMessage().Err(err).Msgf("Token validation failed, using cached result for %s", e.User.Login)
+		return e.user(), nil
+	default:
+		return user, err
+	}
+}
+
+func (c *cached) store(key string, e entry, ttl time.Duration) {
+	if err := c.kv.SetJSONWithMaxRetries(key, e, ttl, retries); err != nil {
+		c.logger.LogWarnMessage().Err(err).Msg("Failed to cache token validation")
+	}
+}
+
+func (e entry) user() github.User {
+	user := e.User
+	user.MaxTunnels = e.MaxTunnels
+	user.Plan = e.Plan
+	return user
+}
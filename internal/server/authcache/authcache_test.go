@@ -0,0 +1,142 @@
+package authcache
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/harsh082ip/ZapTun/internal/server/github"
+	"github.com/harsh082ip/ZapTun/pkg/db/redis"
+	log "github.com/harsh082ip/ZapTun/pkg/logger"
+	"github.com/rs/zerolog"
+)
+
+// fakeGitHub serves the user endpoints of the GitHub API for the token "good".
+type fakeGitHub struct {
+	*httptest.Server
+	userCalls atomic.Int32
+	down      atomic.Bool // answer every request with 502
+}
+
+func newFakeGitHub(t *testing.T) *fakeGitHub {
+	f := &fakeGitHub{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/user", func(w http.ResponseWriter, r *http.Request) {
+		f.userCalls.Add(1)
+		if r.Header.Get("Authorization") != "token gho_good" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{"id": 1, "login": "Alice", "created_at": "2020-01-01T00:00:00Z"})
+	})
+	mux.HandleFunc("/user/orgs", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `[{"login": "Acme"}]`)
+	})
+	mux.HandleFunc("/user/teams", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `[{"slug": "ops", "organization": {"login": "Acme"}}]`)
+	})
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if f.down.Load() {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func newTestCache(t *testing.T, opts Options) (github.Authenticator, *fakeGitHub) {
+	f := newFakeGitHub(t)
+	inner := github.NewWithEndpoints("id", "secret", github.Endpoints{APIURL: f.URL})
+	logger := log.NewLogger(io.Discard, zerolog.Disabled, "test")
+	return New(inner, redis.NewMemoryStore(), opts, logger), f
+}
+
+func TestCachesValidToken(t *testing.T) {
+	auth, f := newTestCache(t, Options{})
+	for i := 0; i < 3; i++ {
+		user, err := auth.Authenticate("good")
+		if err != nil {
+			t.Fatalf("Authenticate #%d: %v", i, err)
+		}
+		if user.Login != "alice" || len(user.Orgs) != 1 || user.Orgs[0] != "acme" || len(user.Teams) != 1 || user.Teams[0] != "acme/ops" {
+			t.Errorf("Authenticate #%d = %+v", i, user)
+		}
+	}
+	if n := f.userCalls.Load(); n != 1 {
+		t.Errorf("GitHub was asked %d times, want 1", n)
+	}
+}
+
+func TestRevalidatesAfterTTL(t *testing.T) {
+	auth, f := newTestCache(t, Options{TTL: 20 * time.Millisecond})
+	if _, err := auth.Authenticate("good"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(40 * time.Millisecond)
+	if _, err := auth.Authenticate("good"); err != nil {
+		t.Fatal(err)
+	}
+	if n := f.userCalls.Load(); n != 2 {
+		t.Errorf("GitHub was asked %d times, want 2", n)
+	}
+}
+
+func TestCachesInvalidToken(t *testing.T) {
+	auth, f := newTestCache(t, Options{NegativeTTL: 50 * time.Millisecond})
+	for i := 0; i < 2; i++ {
+		if _, err := auth.Authenticate("bad"); !errors.Is(err, github.ErrInvalidToken) {
+			t.Fatalf("Authenticate #%d: err = %v, want ErrInvalidToken", i, err)
+		}
+	}
+	if n := f.userCalls.Load(); n != 1 {
+		t.Errorf("GitHub was asked %d times, want 1", n)
+	}
+
+	time.Sleep(70 * time.Millisecond)
+	auth.Authenticate("bad")
+	if n := f.userCalls.Load(); n != 2 {
+		t.Errorf("after the negative TTL GitHub was asked %d times, want 2", n)
+	}
+}
+
+func TestStaleFallbackWhileGitHubIsDown(t *testing.T) {
+	auth, f := newTestCache(t, Options{TTL: 10 * time.Millisecond, StaleTTL: 100 * time.Millisecond})
+	if _, err := auth.Authenticate("good"); err != nil {
+		t.Fatal(err)
+	}
+	f.down.Store(true)
+	time.Sleep(20 * time.Millisecond)
+
+	user, err := auth.Authenticate("good")
+	if err != nil || user.Login != "alice" {
+		t.Fatalf("Authenticate during outage = %+v, %v, want the cached user", user, err)
+	}
+	// tokens GitHub never vouched for are not let in
+	if _, err := auth.Authenticate("other"); err == nil {
+		t.Error("unknown token accepted during outage")
+	}
+
+	time.Sleep(120 * time.Millisecond)
+	if _, err := auth.Authenticate("good"); err == nil {
+		t.Error("cached user still accepted after the stale period")
+	}
+}
+
+func TestOutageIsNotCachedAsInvalid(t *testing.T) {
+	auth, f := newTestCache(t, Options{})
+	f.down.Store(true)
+	if _, err := auth.Authenticate("good"); err == nil || errors.Is(err, github.ErrInvalidToken) {
+		t.Fatalf("Authenticate during outage: err = %v, want a provider error", err)
+	}
+	f.down.Store(false)
+	if _, err := auth.Authenticate("good"); err != nil {
+		t.Errorf("Authenticate after outage: %v", err)
+	}
+}
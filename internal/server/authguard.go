@@ -0,0 +1,196 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/harsh082ip/ZapTun/config"
+	"github.com/harsh082ip/ZapTun/internal/server/credential"
+	"github.com/harsh082ip/ZapTun/internal/server/github"
+	"github.com/harsh082ip/ZapTun/internal/server/netaddr"
+	"github.com/harsh082ip/ZapTun/pkg/db/redis"
+	"github.com/harsh082ip/ZapTun/pkg/tunnel"
+)
+
+const (
+	authFailureKeyPrefix = "zaptun:authfail"
+
+	defaultAuthMaxFailures         = 10
+	defaultAuthFailureWindow       = 10 * time.Minute
+	defaultAuthLockout             = 15 * time.Minute
+	defaultMaxPendingSessions      = 256
+	defaultMaxPendingSessionsPerIP = 8
+
+	// authTimeout bounds everything between accepting a control connection and
+	// sending the auth result, so idle connections cannot hold pending slots
+	authTimeout = 30 * time.Second
+)
+
+// authFailures is the failure counter of one address or token.
+type authFailures struct {
+	Count       int       `json:"count"`
+	Since       time.Time `json:"since"` // start of the current window
+	LockedUntil time.Time `json:"locked_until,omitempty"`
+}
+
+// authGuard protects authentication against brute force: it locks out addresses
+// and tokens with too many rejected logins and caps the connections that have not
+// authenticated yet. Counters are kept in the KV store; concurrent updates from
+// several servers may lose a count, which only delays a lockout a little.
+type authGuard struct {
+	kv          redis.RedisStoreWithRetries
+	maxFailures int
+	window      time.Duration
+	lockout     time.Duration
+	maxPending  int
+	maxPerIP    int
+
+	mutex     sync.Mutex
+	pending   int
+	pendingBy map[string]int // address -> pending connections
+}
+
+func newAuthGuard(conf *config.ServerConfig, kv redis.RedisStoreWithRetries) *authGuard {
+	g := &authGuard{
+		kv:          kv,
+		maxFailures: defaultAuthMaxFailures,
+		window:      defaultAuthFailureWindow,
+		lockout:     defaultAuthLockout,
+		maxPending:  defaultMaxPendingSessions,
+		maxPerIP:    defaultMaxPendingSessionsPerIP,
+		pendingBy:   make(map[string]int),
+	}
+	if conf.AuthMaxFailures != 0 {
+		g.maxFailures = conf.AuthMaxFailures
+	}
+	if conf.AuthFailureWindowSeconds > 0 {
+		g.window = time.Duration(conf.AuthFailureWindowSeconds) * time.Second
+	}
+	if conf.AuthLockoutSeconds > 0 {
+		g.lockout = time.Duration(conf.AuthLockoutSeconds) * time.Second
+	}
+	if conf.MaxPendingSessions > 0 {
+		g.maxPending = conf.MaxPendingSessions
+	}
+	if conf.MaxPendingSessionsPerIP > 0 {
+		g.maxPerIP = conf.MaxPendingSessionsPerIP
+	}
+	return g
+}
+
+// clientAddr returns the address counters are kept for, see netaddr.Group.
+func clientAddr(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return netaddr.Group(host)
+}
+
+// admit reserves a pending slot for a new connection from ip. It returns false
+// when the server or ip already has too many connections authenticating.
+func (g *authGuard) admit(ip string) bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if g.pending >= g.maxPending || g.pendingBy[ip] >= g.maxPerIP {
+		return false
+	}
+	g.pending++
+	g.pendingBy[ip]++
+	return true
+}
+
+// done releases the pending slot taken by admit.
+func (g *authGuard) done(ip string) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.pending--
+	if g.pendingBy[ip]--; g.pendingBy[ip] <= 0 {
+		delete(g.pendingBy, ip)
+	}
+}
+
+func authFailureKeys(ip, token string) []string {
+	keys := []string{fmt.Sprintf("%s:ip:%s", authFailureKeyPrefix, ip)}
+	if token != "" {
+		sum := sha256.Sum256([]byte(token))
+		keys = append(keys, fmt.Sprintf("%s:token:%s", authFailureKeyPrefix, hex.EncodeToString(sum[:])))
+	}
+	return keys
+}
+
+func (g *authGuard) load(key string) (*authFailures, error) {
+	var f authFailures
+	if found, err := redis.GetJSONIfExists(g.kv, key, &f); err != nil || !found {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// lockedOut returns how long ip or token stay locked out, zero if neither is.
+func (g *authGuard) lockedOut(ip, token string) (time.Duration, error) {
+	if g.maxFailures < 0 {
+		return 0, nil
+	}
+	var remaining time.Duration
+	for _, key := range authFailureKeys(ip, token) {
+		f, err := g.load(key)
+		if err != nil {
+			return 0, err
+		}
+		if f != nil {
+			remaining = max(remaining, time.Until(f.LockedUntil))
+		}
+	}
+	return remaining, nil
+}
+
+// recordFailure counts a rejected login of token from ip and reports whether
+// that locked either of them out.
+func (g *authGuard) recordFailure(ip, token string) (bool, error) {
+	if g.maxFailures < 0 {
+		return false, nil
+	}
+	now := time.Now()
+	locked := false
+	for _, key := range authFailureKeys(ip, token) {
+		f, err := g.load(key)
+		if err != nil {
+			return false, err
+		}
+		if f == nil || now.Sub(f.Since) > g.window {
+			f = &authFailures{Since: now}
+		}
+		f.Count++
+		ttl := g.window - now.Sub(f.Since)
+		if f.Count >= g.maxFailures {
+			f.LockedUntil = now.Add(g.lockout)
+			ttl = g.lockout
+			locked = true
+		}
+		if err := g.kv.SetJSONWithMaxRetries(key, f, max(ttl, time.Second), storeRetries); err != nil {
+			return false, err
+		}
+	}
+	return locked, nil
+}
+
+// countsAsFailure reports whether an authentication error is a wrong or forged
+// token. Provider outages and expired credentials of real users are not counted.
+func countsAsFailure(err error) bool {
+	return errors.Is(err, github.ErrInvalidToken) && !credential.IsExpired(err)
+}
+
+// lockedOutError is sent to clients that are locked out for remaining.
+func lockedOutError(remaining time.Duration) *tunnel.Message {
+	return &tunnel.Message{Type: tunnel.MsgError, Error: &tunnel.Error{
+		Code:    tunnel.ErrAuthFailed,
+		Reason:  tunnel.AuthLockedOut,
+		Message: fmt.Sprintf("too many failed logins, try again in %s", remaining.Round(time.Second)),
+	}}
+}
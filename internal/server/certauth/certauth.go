@@ -0,0 +1,75 @@
+// Package certauth authenticates clients by the TLS client certificate they present
+// on the control plane, for machine-to-machine tunnels (e.g. CI runners) that hold a
+// certificate from an internal CA instead of a GitHub token.
+//
+// The user is taken from the certificate subject: the common name is the login,
+// organizations (O) become orgs and each organizational unit (OU) becomes the
+// team "<org>/<ou>", so policies and plans apply to certificates as to GitHub users.
+package certauth
+
+import (
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/harsh082ip/ZapTun/internal/server/github"
+)
+
+// Authenticator trusts client certificates issued by the CAs in its pool. It also
+// implements github.Authenticator for servers that accept certificates only, in
+// which case every token is rejected.
+type Authenticator struct {
+	pool *x509.CertPool
+}
+
+// Load reads the PEM bundle of client CAs at path.
+func Load(path string) (*Authenticator, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading client CA bundle: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in client CA bundle %s", path)
+	}
+	return &Authenticator{pool: pool}, nil
+}
+
+// ClientCAs returns the pool to verify client certificates against during the
+// TLS handshake.
+func (a *Authenticator) ClientCAs() *x509.CertPool {
+	return a.pool
+}
+
+// AuthenticateCertificate maps a client certificate that the TLS handshake already
+// verified against ClientCAs to a user.
+func (a *Authenticator) AuthenticateCertificate(cert *x509.Certificate) (github.User, error) {
+	login := strings.ToLower(strings.TrimSpace(cert.Subject.CommonName))
+	if !github.ValidLogin(login) {
+		return github.User{}, fmt.Errorf("certificate common name %q is not a valid login: %w", cert.Subject.CommonName, github.ErrInvalidToken)
+	}
+	user := github.User{
+		Name:    cert.Subject.CommonName,
+		Login:   login,
+		Allowed: true,
+	}
+	for _, o := range cert.Subject.Organization {
+		org := strings.ToLower(o)
+		user.Orgs = append(user.Orgs, org)
+		for _, ou := range cert.Subject.OrganizationalUnit {
+			user.Teams = append(user.Teams, org+"/"+strings.ToLower(ou))
+		}
+	}
+	return user, nil
+}
+
+func (a *Authenticator) GetOAuthUrl(string) string { return "" }
+
+func (a *Authenticator) ExchangeCodeForToken(code string) (string, error) {
+	return "", fmt.Errorf("client certificates do not support the oauth flow")
+}
+
+func (a *Authenticator) Authenticate(token string) (github.User, error) {
+	return github.User{}, fmt.Errorf("this server only accepts client certificates: %w", github.ErrInvalidToken)
+}
@@ -0,0 +1,185 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/harsh082ip/ZapTun/config"
+	"github.com/harsh082ip/ZapTun/internal/server/filewatch"
+	log "github.com/harsh082ip/ZapTun/pkg/logger"
+)
+
+// certificates expiring sooner are warned about, once a day
+const certExpiryWarning = 14 * 24 * time.Hour
+
+// certFile is a certificate and key pair on disk, reloaded when either changes.
+type certFile struct {
+	name     string // what the certificate is for, used in log messages
+	certPath string
+	keyPath  string
+	// checkHost is a name the certificate must cover, empty to skip the check
+	checkHost string
+
+	cert atomic.Pointer[tls.Certificate]
+}
+
+// load reads and validates the pair. On error the previous certificate stays in
+// use until the files change again.
+func (f *certFile) load() error {
+	cert, err := tls.LoadX509KeyPair(f.certPath, f.keyPath)
+	if err != nil {
+		return fmt.Errorf("error loading certificate for %s: %w", f.name, err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("error parsing certificate for %s: %w", f.name, err)
+	}
+	if f.checkHost != "" {
+		if err := leaf.VerifyHostname(f.checkHost); err != nil {
+			return fmt.Errorf("certificate %s is not valid for %s: %w", f.certPath, f.name, err)
+		}
+	}
+	cert.Leaf = leaf
+	f.cert.Store(&cert)
+	return nil
+}
+
+// getCertificate returns the current certificate.
+func (f *certFile) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return f.cert.Load(), nil
+}
+
+// certStore holds the certificates of the control and data planes and picks the
+// data plane one for a TLS handshake by the server name the visitor asked for.
+type certStore struct {
+	logger   *log.Logger
+	control  *certFile
+	wildcard *certFile            // *.<domain>, also used without SNI; nil without HTTPS
+	hosts    map[string]*certFile // exact names and "*.<parent>" wildcards
+}
+
+// loadCertStore reads the certificates configured in conf. It fails if any of
+// them cannot be used, so the server does not start with a broken one.
+func loadCertStore(conf *config.ServerConfig, logger *log.Logger) (*certStore, error) {
+	certPath, keyPath := "cert.pem", "privkey.pem"
+	if conf.CertificatePath != "" && conf.PrivateKeyPath != "" {
+		certPath, keyPath = conf.CertificatePath, conf.PrivateKeyPath
+	}
+	cs := &certStore{
+		logger:  logger,
+		control: &certFile{name: "the control plane", certPath: certPath, keyPath: keyPath},
+		hosts:   make(map[string]*certFile),
+	}
+	files := []*certFile{cs.control}
+
+	if conf.DataPlaneTLSAddr != "" {
+		if conf.WildcardCertificatePath != "" && conf.WildcardPrivateKeyPath != "" {
+			certPath, keyPath = conf.WildcardCertificatePath, conf.WildcardPrivateKeyPath
+		}
+		cs.wildcard = &certFile{name: "*." + conf.Domain, certPath: certPath, keyPath: keyPath, checkHost: "zaptun." + conf.Domain}
+		files = append(files, cs.wildcard)
+		for _, hc := range conf.HostCertificates {
+			host := strings.ToLower(hc.Host)
+			f := &certFile{name: host, certPath: hc.CertificatePath, keyPath: hc.PrivateKeyPath, checkHost: strings.Replace(host, "*", "zaptun", 1)}
+			cs.hosts[host] = f
+			files = append(files, f)
+		}
+	}
+
+	for _, f := range files {
+		if err := f.load(); err != nil {
+			return nil, err
+		}
+	}
+	cs.warnExpiry()
+	return cs, nil
+}
+
+// files returns every certificate of the store.
+func (cs *certStore) files() []*certFile {
+	files := []*certFile{cs.control}
+	if cs.wildcard != nil {
+		files = append(files, cs.wildcard)
+	}
+	for _, f := range cs.hosts {
+		files = append(files, f)
+	}
+	return files
+}
+
+// ControlCertificate implements tls.Config.GetCertificate for the control plane.
+func (cs *certStore) ControlCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return cs.control.getCertificate(hello)
+}
+
+// DataCertificate implements tls.Config.GetCertificate for the data plane: an
+// exact host match wins over a wildcard one, and anything else gets the
+// certificate for *.<domain>.
+func (cs *certStore) DataCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if f, ok := cs.hosts[name]; ok {
+		return f.getCertificate(hello)
+	}
+	if _, parent, ok := strings.Cut(name, "."); ok {
+		if f, ok := cs.hosts["*."+parent]; ok {
+			return f.getCertificate(hello)
+		}
+	}
+	return cs.wildcard.getCertificate(hello)
+}
+
+// warnExpiry logs certificates that have expired or expire soon.
+func (cs *certStore) warnExpiry() {
+	for _, f := range cs.files() {
+		cs.warnFileExpiry(f)
+	}
+}
+
+func (cs *certStore) warnFileExpiry(f *certFile) {
+	notAfter := f.cert.Load().Leaf.NotAfter
+	switch left := time.Until(notAfter); {
+	case left <= 0:
+		cs.logger.LogErrorMessage().Msgf("Certificate for %s (%s) expired on %s", f.name, f.certPath, notAfter.Format(time.RFC3339))
+	case left < certExpiryWarning:
+		cs.logger.LogWarnMessage().Msgf("Certificate for %s (%s) expires in %s, on %s",
+			f.name, f.certPath, left.Round(time.Hour), notAfter.Format(time.RFC3339))
+	}
+}
+
+// Watch has w reload each certificate on SIGHUP and whenever its files change, so
+// renewed certificates are served without a restart. Existing connections keep
+// the certificate they were established with.
+func (cs *certStore) Watch(w *filewatch.Watcher) {
+	for _, f := range cs.files() {
+		w.Add(func() { cs.reload(f) }, f.certPath, f.keyPath)
+	}
+}
+
+func (cs *certStore) reload(f *certFile) {
+	if err := f.load(); err != nil {
+		cs.logger.LogErrorMessage().Err(err).Msgf("Failed to reload certificate for %s, keeping the current one", f.name)
+		return
+	}
+	cs.logger.LogInfoMessage().Msgf("Reloaded certificate for %s from %s, valid until %s",
+		f.name, f.certPath, f.cert.Load().Leaf.NotAfter.Format(time.RFC3339))
+	cs.warnFileExpiry(f)
+}
+
+// WarnExpiryDaily repeats the expiry warnings once a day until ctx is done.
+func (cs *certStore) WarnExpiryDaily(ctx context.Context) {
+	ticker := time.NewTicker(24 * time.Hour)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			cs.warnExpiry()
+		}
+	}
+}
@@ -2,31 +2,47 @@ package server
 
 import (
 	"crypto/tls"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
 
-	"github.com/harsh082ip/ZapTun/internal/server/github"
+	"github.com/harsh082ip/ZapTun/internal/mux"
+	"github.com/harsh082ip/ZapTun/internal/server/credential"
 	"github.com/harsh082ip/ZapTun/pkg/tunnel"
-	"github.com/hashicorp/yamux"
 )
 
-func (s *Server) startControlPlane() {
-	certPath := "cert.pem"
-	keyPath := "privkey.pem"
+// handshakeTimeout bounds the TLS handshake of a new control connection.
+const handshakeTimeout = 10 * time.Second
 
-	if s.conf.CertificatePath != "" && s.conf.PrivateKeyPath != "" {
-		certPath = s.conf.CertificatePath
-		keyPath = s.conf.PrivateKeyPath
-	}
+// rejectLinger is how long a rejected client gets to read the error and hang up.
+const rejectLinger = 2 * time.Second
 
-	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+// subdomainPattern matches a single DNS label.
+var subdomainPattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+
+func (s *Server) startControlPlane() {
+	multiplexers, err := s.multiplexers()
 	if err != nil {
-		s.logger.LogInfoMessage().Msgf("Failed to load TLS certificate, err:%v", err)
+		s.logger.LogErrorMessage().Err(err).Msg("Invalid multiplexers in server config")
+		return
 	}
 
-	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+	tlsConfig := &tls.Config{
+		GetCertificate: s.certs.ControlCertificate,
+		NextProtos:     mux.ALPN(multiplexers),
+	}
+	if s.certAuth != nil {
+		tlsConfig.ClientCAs = s.certAuth.ClientCAs()
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		if s.conf.AuthBackend == "mtls" {
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
 	listener, err := net.Listen("tcp", s.conf.ControlPlaneAddr)
 	if err != nil {
 		s.logger.LogErrorMessage().Msgf("failed to start control plane on: %v, err: %+v", s.conf.ControlPlaneAddr, err)
@@ -35,9 +51,21 @@ func (s *Server) startControlPlane() {
 	tlsListener := tls.NewListener(listener, tlsConfig)
 	defer tlsListener.Close()
 
+	s.mutex.Lock()
+	if s.draining {
+		s.mutex.Unlock()
+		return
+	}
+	s.controlListener = tlsListener
+	s.mutex.Unlock()
+
 	s.logger.LogInfoMessage().Msgf("Starting Control Plane on: %v", s.conf.ControlPlaneAddr)
 	for {
 		conn, err := tlsListener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			s.logger.LogInfoMessage().Msg("Control plane stopped accepting connections")
+			return
+		}
 		if err != nil {
 			s.logger.LogErrorMessage().Msgf("failed to accept connection on control plane, err: %+v", err)
 			continue
@@ -48,248 +76,649 @@ func (s *Server) startControlPlane() {
 	}
 }
 
+// rejectSession sends msg, usually an error, before the session is torn down and
+// waits for the client to hang up first, so that closing the connection right away
+// cannot discard the message or fail the client's own pending writes.
+func rejectSession(ctrlStream net.Conn, ctrl *tunnel.ControlConn, msg *tunnel.Message) {
+	if err := ctrl.Send(msg); err != nil {
+		return
+	}
+	ctrlStream.SetReadDeadline(time.Now().Add(rejectLinger))
+	io.Copy(io.Discard, ctrlStream)
+}
+
+// replyError answers a failed command of sess with err. Anything but a protocol
+// error is logged as the failure of command and sent as ErrInternal.
+func (s *Server) replyError(sess *Session, command string, err error) {
+	var serverErr *tunnel.Error
+	if !errors.As(err, &serverErr) {
+		s.logger.LogErrorMessage().Err(err).Msgf("%s failed for %s", command, sess.user.Login)
+		serverErr = &tunnel.Error{Code: tunnel.ErrInternal, Message: err.Error()}
+	}
+	sess.ctrl.Send(&tunnel.Message{Type: tunnel.MsgError, Error: serverErr})
+}
+
+// multiplexers returns the configured stream multiplexers, or all built-in ones.
+func (s *Server) multiplexers() ([]string, error) {
+	if len(s.conf.Multiplexers) == 0 {
+		return mux.Names(), nil
+	}
+	for _, name := range s.conf.Multiplexers {
+		if _, err := mux.Get(name); err != nil {
+			return nil, err
+		}
+	}
+	return s.conf.Multiplexers, nil
+}
+
 func (s *Server) handleConnection(conn net.Conn) {
 	defer conn.Close()
 
-	s.logger.LogInfoMessage().Msg("New client connected...")
-	fmt.Printf("%s", conn.RemoteAddr())
+	// connections hold a pending slot until they are authenticated
+	ip := clientAddr(conn.RemoteAddr())
+	if !s.guard.admit(ip) {
+		s.logger.LogWarnMessage().Msgf("Too many unauthenticated connections, dropping %s", conn.RemoteAddr())
+		return
+	}
+	authenticated := sync.OnceFunc(func() { s.guard.done(ip) })
+	defer authenticated()
+
+	s.logger.LogInfoMessage().Msgf("New client connected from %s", conn.RemoteAddr())
 
-	// yamux config
-	yamuxConfig := yamux.DefaultConfig()
-	yamuxConfig.EnableKeepAlive = false
-	// yamuxConfig.KeepAliveInterval = 60 * time.Hour
-	// yamuxConfig.ConnectionWriteTimeout = 15 * time.Second
+	// the multiplexer is picked via ALPN, so finish the TLS handshake first
+	tlsConn := conn.(*tls.Conn)
+	tlsConn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		s.logger.LogWarnMessage().Err(err).Msgf("TLS handshake with %s failed", conn.RemoteAddr())
+		return
+	}
+	tlsConn.SetDeadline(time.Now().Add(authTimeout))
+	// validated when the control plane started
+	enabled, _ := s.multiplexers()
+	m, err := mux.Negotiated(tlsConn.ConnectionState().NegotiatedProtocol, enabled)
+	if err != nil {
+		s.logger.LogWarnMessage().Err(err).Msgf("No usable multiplexer for %s", conn.RemoteAddr())
+		return
+	}
 
-	// wrap raw TCP into a yamux session
-	session, err := yamux.Server(conn, yamuxConfig)
+	session, err := m.Server(conn)
 	if err != nil {
-		s.logger.LogErrorMessage().Err(err).Msg("Failed to create yamux session")
+		s.logger.LogErrorMessage().Err(err).Msgf("Failed to create %s session", m.Name())
 		return
 	}
+	defer session.Close()
+	s.logger.LogDebugMessage().Msgf("Using %s multiplexer for %s", m.Name(), conn.RemoteAddr())
 
-	// The client is expected to open a stream. We'll wait for it.
-	// This stream will be used for control messages in the future.
-	// For now, accepting it proves the session is working.
+	// The client is expected to open the control stream first.
 	ctrlStream, err := session.AcceptStream()
 	if err != nil {
 		s.logger.LogErrorMessage().Err(err).Msg("Failed to accept control stream")
-		session.Close()
 		return
 	}
+	ctrl := tunnel.NewControlConn(ctrlStream)
 
-	// get access token from client
-	var token string
-	if err := json.NewDecoder(ctrlStream).Decode(&token); err != nil {
-		s.logger.LogErrorMessage().Err(err).Msgf("failed to get Auth token from client")
+	msg, err := ctrl.Expect(tunnel.MsgHello)
+	if err == tunnel.ErrLegacyPeer {
+		// old clients only understand a single text line and exit on anything but auth_ok
+		s.logger.LogWarnMessage().Msgf("Rejecting legacy client from %s", conn.RemoteAddr())
+		ctrlStream.Write([]byte("err: this zaptun-client is too old for the server, please upgrade from https://zaptun.com\n"))
+		return
+	}
+	if err != nil {
+		s.logger.LogErrorMessage().Err(err).Msgf("failed to read hello from client")
+		rejectSession(ctrlStream, ctrl, tunnel.NewError(tunnel.ErrBadRequest, "expected hello message"))
+		return
+	}
+	hello := msg.Hello
+	if hello.ProtocolVersion < tunnel.MinProtocolVersion {
+		s.logger.LogWarnMessage().Msgf("Client %s uses unsupported protocol version %d", hello.ClientVersion, hello.ProtocolVersion)
+		rejectSession(ctrlStream, ctrl, tunnel.NewError(tunnel.ErrUnsupportedVersion,
+			"protocol version %d is not supported (server needs >= %d), please upgrade zaptun-client",
+			hello.ProtocolVersion, tunnel.MinProtocolVersion))
 		return
 	}
 
-	// validate auth token
-	user, err := s.authenticator.Authenticate(token)
+	// validate auth token; a certificate verified during the handshake cannot be guessed
+	peerCerts := tlsConn.ConnectionState().PeerCertificates
+	guarded := len(peerCerts) == 0
+	if guarded {
+		remaining, err := s.guard.lockedOut(ip, hello.Token)
+		if err != nil {
+			s.logger.LogErrorMessage().Err(err).Msg("Failed to look up failed logins")
+		}
+		if remaining > 0 {
+			s.logger.LogWarnMessage().Msgf("Rejected locked out client from %s", conn.RemoteAddr())
+			rejectSession(ctrlStream, ctrl, lockedOutError(remaining))
+			return
+		}
+	}
+	user, claims, token, err := s.authenticate(hello.Token, peerCerts)
+	var renew bool
+	if err == nil {
+		user, renew, err = s.refreshLogin(user, claims, hello.ProviderToken)
+	}
+	if guarded && countsAsFailure(err) {
+		locked, err := s.guard.recordFailure(ip, hello.Token)
+		if err != nil {
+			s.logger.LogErrorMessage().Err(err).Msg("Failed to record failed login")
+		}
+		if locked {
+			s.logger.LogWarnMessage().Msgf("Locking out %s after repeated failed logins", ip)
+		}
+	}
+	if credential.IsExpired(err) || errors.Is(err, errTokenRevoked) || errors.Is(err, errLoginRevoked) {
+		s.logger.LogInfoMessage().Msgf("Rejected credential from %s: %v", conn.RemoteAddr(), err)
+		rejectSession(ctrlStream, ctrl, tokenRejected(err))
+		return
+	}
 	if err != nil {
 		s.logger.LogErrorMessage().Err(err).Msgf("failed to authenticate user")
-		// also tell the client
-		msg := fmt.Sprintf("authentication failed %s", "obtain auth token from https://zaptun.com/auth\n")
-		if _, err := ctrlStream.Write([]byte(msg)); err != nil {
-			s.logger.LogErrorMessage().Err(err).Msgf("failed to send auth error msg to the client")
-		}
+		rejectSession(ctrlStream, ctrl, tunnel.NewError(tunnel.ErrAuthFailed, "authentication failed, obtain auth token from https://zaptun.com/auth"))
+		return
 	}
-	s.logger.LogInfoMessage().Msgf("allowd: %v", user.Allowed)
-
 	if !user.Allowed {
-		msg := fmt.Sprintf("authentication failed %s", "obtain auth token from https://zaptun.com/auth\n")
-		if _, err := ctrlStream.Write([]byte(msg)); err != nil {
-			s.logger.LogErrorMessage().Err(err).Msgf("failed to send auth error msg to the client")
-		}
+		s.logger.LogWarnMessage().Msgf("user %v is not allowed to open tunnels", user.Login)
+		rejectSession(ctrlStream, ctrl, tunnel.NewError(tunnel.ErrAccessDenied, "user %s is not allowed to open tunnels", user.Login))
+		return
+	}
+	if decision := s.policy.Evaluate(user); !decision.Allowed {
+		s.logger.LogWarnMessage().Msgf("Policy denied %s: %s", user.Login, decision.Reason)
+		rejectSession(ctrlStream, ctrl, accessDenied(decision))
+		return
 	}
 
-	if _, err := ctrlStream.Write([]byte("auth_ok\n")); err != nil {
-		s.logger.LogErrorMessage().Err(err).Msgf("failed to send auth success msg to client")
+	version := hello.ProtocolVersion
+	if version > tunnel.ProtocolVersion {
+		version = tunnel.ProtocolVersion
+	}
+	plan := s.planFor(user)
+	authResult := &tunnel.AuthResult{
+		ProtocolVersion: version,
+		ServerVersion:   tunnel.Version,
+		Login:           user.Login,
+		Features:        tunnel.NegotiateFeatures(tunnel.SupportedFeatures, hello.Features),
+		Plan:            &plan,
+	}
+	var tokenID string
+	if len(peerCerts) == 0 {
+		// a client certificate is its own credential
+		tokenID = s.issueCredential(authResult, user, claims, token, hello.MachineName, renew)
+	}
+	interval, timeout := s.heartbeatSettings()
+	if tunnel.HasFeature(authResult.Features, tunnel.FeatureHeartbeat) {
+		authResult.HeartbeatIntervalMs = interval.Milliseconds()
+		authResult.HeartbeatTimeoutMs = timeout.Milliseconds()
+	}
+	if err := ctrl.Send(&tunnel.Message{Type: tunnel.MsgAuthResult, AuthResult: authResult}); err != nil {
+		s.logger.LogErrorMessage().Err(err).Msgf("failed to send auth result to client")
+		return
+	}
+	tlsConn.SetDeadline(time.Time{})
+	authenticated()
+
+	sess := &Session{
+		user:     user,
+		plan:     plan,
+		tokenID:  tokenID,
+		features: authResult.Features,
+		mux:      session,
+		ctrl:     ctrl,
+		tunnels:  make(map[string]*Client),
+	}
+	s.mutex.Lock()
+	if s.draining {
+		s.mutex.Unlock()
+		s.refuseDraining(ctrl)
 		return
 	}
+	s.sessions[sess] = struct{}{}
+	s.mutex.Unlock()
+	// tunnels of a session that drops without saying goodbye are held for resumption
+	closedByClient := false
+	defer func() { s.closeSession(sess, !closedByClient) }()
+
+	if authResult.HeartbeatIntervalMs > 0 {
+		sess.heartbeat = ctrl.StartHeartbeat(interval, timeout,
+			func() {
+				// closing the mux session fails the Recv below, which removes the tunnels
+				s.logger.LogWarnMessage().Msgf("No heartbeat from %s for %s, closing session", user.Login, timeout)
+				session.Close()
+			},
+			func(rtt time.Duration) {
+				s.logger.LogDebugMessage().Msgf("Heartbeat RTT for %s: %s", user.Login, rtt)
+			})
+	}
+
+	// serve tunnel requests until the client closes the session or goes away
+	for {
+		msg, err := ctrl.Recv()
+		if err != nil {
+			return
+		}
+		if !msg.Valid() {
+			ctrl.Send(tunnel.NewError(tunnel.ErrBadRequest, "%s message without payload", msg.Type))
+			continue
+		}
+		switch msg.Type {
+		case tunnel.MsgTunnelRequest:
+			s.openTunnel(sess, msg.TunnelRequest)
+		case tunnel.MsgReserve, tunnel.MsgRelease, tunnel.MsgListReservations:
+			s.handleReservation(sess, msg)
+		case tunnel.MsgListTokens, tunnel.MsgRenameToken, tunnel.MsgRevokeToken:
+			s.handleTokenCommand(sess, msg)
+		case tunnel.MsgClose:
+			if msg.Close != nil && msg.Close.Reason != "" {
+				s.logger.LogInfoMessage().Msgf("Client %s closed session: %s", user.Login, msg.Close.Reason)
+			}
+			closedByClient = true
+			return
+		default:
+			s.logger.LogWarnMessage().Msgf("Ignoring unexpected control message %q from %s", msg.Type, user.Login)
+		}
+	}
+}
 
-	// decode tunnel type from ctrlstream
-	var msg tunnel.ControlMessage
-	if err := json.NewDecoder(ctrlStream).Decode(&msg); err != nil {
-		s.logger.LogErrorMessage().Err(err).Msg("Failed to decode control message")
+func (s *Server) openTunnel(sess *Session, req *tunnel.TunnelRequest) {
+	s.mutex.RLock()
+	draining := s.draining
+	s.mutex.RUnlock()
+	if draining {
+		s.refuseDraining(sess.ctrl)
 		return
 	}
 
-	switch msg.Type {
+	switch req.Type {
 	case "http":
-		s.handleHTTPTunnel(session, ctrlStream, &user)
+		s.handleHTTPTunnel(sess, req)
 	case "tcp":
-		s.handleTCPTunnel(session, ctrlStream, &user)
+		s.handleTCPTunnel(sess, req)
+	default:
+		sess.ctrl.Send(tunnel.NewError(tunnel.ErrUnknownTunnelType, "unknown tunnel type %q", req.Type))
 	}
 }
 
-func (s *Server) handleHTTPTunnel(session *yamux.Session, ctrlStream net.Conn, user *github.User) {
-	s.logger.LogInfoMessage().Msg("Handling HTTP tunnel request...")
+// userRecord returns the registry entry for the user of sess, creating it if
+// needed. The plan of the most recent session applies to all tunnels of the user.
+// The caller must hold s.mutex.
+func (s *Server) userRecord(sess *Session) *User {
+	login := sess.user.Login
+	userRecord, exists := s.users[login]
+	if !exists {
+		userRecord = &User{tunnels: make(map[string]*Client)}
+		s.users[login] = userRecord
+	}
+	userRecord.plan = sess.plan
+	switch limiter, bandwidth := userRecord.limiter.Load(), sess.plan.BandwidthBytesPerSec; {
+	case bandwidth <= 0:
+		userRecord.limiter.Store(nil)
+	case limiter == nil || limiter.rate != float64(bandwidth):
+		userRecord.limiter.Store(newRateLimiter(bandwidth))
+	}
+	return userRecord
+}
 
-	s.mutex.Lock()
+// registerTunnel adds client to the session, its user and the routing tables.
+// The caller must hold s.mutex.
+func (s *Server) registerTunnel(client *Client) {
+	s.userRecord(client.session).tunnels[client.id] = client
+	client.session.tunnels[client.id] = client
+	if client.tunnelType == "http" {
+		s.httpTunnels[client.id] = client
+	}
+	if client.resumeToken != "" {
+		s.resumable[client.resumeToken] = client
+	}
+}
 
-	userRecord, exists := s.users[user.Login]
-	if !exists {
-		userRecord = &User{
-			tunnels:   make(map[string]*Client),
-			maxTunnel: 2,
+// removeTunnel drops client from every registry and closes its public listener.
+// With hold set, its address stays reserved for the resume grace period.
+// The caller must hold s.mutex.
+func (s *Server) removeTunnel(client *Client, hold bool) {
+	login := client.session.user.Login
+	if userRec, ok := s.users[login]; ok {
+		delete(userRec.tunnels, client.id)
+		if len(userRec.tunnels) == 0 && userRec.streams == 0 {
+			delete(s.users, login)
 		}
-		s.users[user.Login] = userRecord
 	}
+	delete(client.session.tunnels, client.id)
+	if s.httpTunnels[client.id] == client {
+		delete(s.httpTunnels, client.id)
+	}
+	if s.resumable[client.resumeToken] == client {
+		delete(s.resumable, client.resumeToken)
+	}
+	if client.listener != nil {
+		client.listener.Close()
+	}
+	if hold {
+		s.holdTunnel(client)
+	}
+	s.logger.LogInfoMessage().Msgf("Client tunnel %v disconnected. Removed from registry.", client.id)
+}
 
-	if len(userRecord.tunnels) >= userRecord.maxTunnel {
+// closeSession removes every tunnel of sess and closes its mux session.
+// hold is passed on to removeTunnel.
+func (s *Server) closeSession(sess *Session, hold bool) {
+	if sess.heartbeat != nil {
+		sess.heartbeat.Stop()
+	}
+	s.mutex.Lock()
+	for _, client := range sess.tunnels {
+		s.removeTunnel(client, hold)
+	}
+	delete(s.sessions, sess)
+	s.mutex.Unlock()
+	sess.mux.Close()
+}
+
+func (s *Server) handleHTTPTunnel(sess *Session, req *tunnel.TunnelRequest) {
+	s.logger.LogInfoMessage().Msg("Handling HTTP tunnel request...")
+	user := sess.user
+
+	// the data plane takes s.mutex on every request, so it is never held while the
+	// KV store is asked about reservations; allocMutex keeps what was found free
+	// free meanwhile
+	s.allocMutex.Lock()
+	defer s.allocMutex.Unlock()
+
+	s.mutex.Lock()
+	resumed := s.resumedTunnel(req.ResumeToken, user.Login, "http")
+	userRecord := s.userRecord(sess)
+	if limit, open := userRecord.tunnelLimit("http"); limit > 0 && open >= limit {
 		s.mutex.Unlock()
-		msg := fmt.Sprintf("err: max http tunnel limit reached (%d)", userRecord.maxTunnel)
-		ctrlStream.Write([]byte(msg + "\n"))
-		s.logger.LogWarnMessage().Msgf("Max tunnel limit reached for user: %v", user.Login)
+		sess.ctrl.Send(tunnel.NewError(tunnel.ErrTunnelLimit, "max HTTP tunnel limit of the %s plan reached (%d)", sess.plan.Name, limit))
+		s.logger.LogWarnMessage().Msgf("Max HTTP tunnel limit reached for user: %v", user.Login)
 		return
 	}
+	var tunnelID string
+	if resumed != nil {
+		tunnelID = resumed.id
+		s.releaseHeld(resumed)
+		s.logger.LogInfoMessage().Msgf("Resuming HTTP tunnel %s for %s", tunnelID, user.Login)
+	}
+	s.mutex.Unlock()
 
-	tunnelID := user.Login
-	if _, idExists := userRecord.tunnels[tunnelID]; idExists {
-		for i := 1; ; i++ {
-			numberedID := fmt.Sprintf("%s-%d", user.Login, i)
-			if _, idExists := userRecord.tunnels[numberedID]; !idExists {
-				tunnelID = numberedID
-				break
+	if resumed == nil && req.Subdomain != "" {
+		if !sess.plan.CustomSubdomains {
+			sess.ctrl.Send(tunnel.NewError(tunnel.ErrPlanRestricted, "custom subdomains are not included in the %s plan", sess.plan.Name))
+			return
+		}
+		name, err := requestedSubdomain(req.Subdomain, user.Login)
+		if err != nil {
+			sess.ctrl.Send(tunnel.NewError(tunnel.ErrSubdomainNotAllowed, "%v", err))
+			return
+		}
+		if reserved, err := s.reservations.reservedByOther(tunnel.ReservationSubdomain, name, user.Login); err != nil || reserved {
+			if err != nil {
+				s.logger.LogErrorMessage().Err(err).Msg("Failed to look up subdomain reservation")
+				sess.ctrl.Send(tunnel.NewError(tunnel.ErrInternal, "could not check subdomain reservation"))
+				return
 			}
+			sess.ctrl.Send(tunnel.NewError(tunnel.ErrSubdomainNotAllowed, "subdomain %s is reserved by another user", name))
+			return
+		}
+		s.mutex.Lock()
+		held := s.heldID(name)
+		if _, taken := s.httpTunnels[name]; taken || (held != nil && held.login != user.Login) {
+			s.mutex.Unlock()
+			sess.ctrl.Send(tunnel.NewError(tunnel.ErrSubdomainTaken, "subdomain %s is already in use", name))
+			s.logger.LogWarnMessage().Msgf("Subdomain %s requested by %s is already in use", name, user.Login)
+			return
+		}
+		if held != nil {
+			// the same user asks for it again, e.g. after restarting the client
+			s.releaseHeld(held)
+		}
+		s.mutex.Unlock()
+		tunnelID = name
+	} else if resumed == nil {
+		var err error
+		if tunnelID, err = s.freeTunnelID(user.Login); err != nil {
+			// without the lookup we could hand out a name someone else reserved
+			s.logger.LogErrorMessage().Err(err).Msg("Failed to look up subdomain reservation")
+			sess.ctrl.Send(tunnel.NewError(tunnel.ErrInternal, "could not check subdomain reservation"))
+			return
 		}
 	}
 
 	newClient := &Client{
-		id:      tunnelID,
-		session: session,
+		id:          tunnelID,
+		tunnelType:  "http",
+		session:     sess,
+		resumeToken: newResumeToken(),
 	}
-	userRecord.tunnels[tunnelID] = newClient
-
+	s.mutex.Lock()
+	s.registerTunnel(newClient)
 	s.mutex.Unlock()
 
-	defer func() {
-		s.mutex.Lock()
-		if userRec, ok := s.users[user.Login]; ok {
-			delete(userRec.tunnels, tunnelID)
-			if len(userRec.tunnels) == 0 {
-				delete(s.users, user.Login)
-			}
-		}
-		s.mutex.Unlock()
-		session.Close()
-		s.logger.LogInfoMessage().Msgf("Client tunnel %v disconnected. Removed from registry.", tunnelID)
-	}()
-
 	assignedURL := fmt.Sprintf("%s.%s", tunnelID, s.conf.Domain)
-	if _, err := ctrlStream.Write([]byte(assignedURL + "\n")); err != nil {
+	err := sess.ctrl.Send(&tunnel.Message{
+		Type:           tunnel.MsgTunnelAssigned,
+		TunnelAssigned: &tunnel.TunnelAssigned{TunnelID: tunnelID, Type: "http", PublicAddr: assignedURL, ResumeToken: newClient.resumeToken},
+	})
+	if err != nil {
 		s.logger.LogErrorMessage().Err(err).Msg("Failed to send assigned URL to client")
 		return
 	}
 	s.logger.LogInfoMessage().Msgf("Assigned URL %s to user %s", assignedURL, user.Login)
+}
 
-	io.Copy(io.Discard, ctrlStream)
+// freeTunnelID returns the first of login, login-1, login-2, ... that is neither
+// in use, held for resumption nor reserved by someone else. The caller must hold
+// s.allocMutex.
+func (s *Server) freeTunnelID(login string) (string, error) {
+	for i := 0; ; i++ {
+		tunnelID := login
+		if i > 0 {
+			tunnelID = fmt.Sprintf("%s-%d", login, i)
+		}
+		s.mutex.Lock()
+		_, inUse := s.httpTunnels[tunnelID]
+		inUse = inUse || s.heldID(tunnelID) != nil
+		s.mutex.Unlock()
+		if inUse {
+			continue
+		}
+		reserved, err := s.reservations.reservedByOther(tunnel.ReservationSubdomain, tunnelID, login)
+		if err != nil {
+			return "", err
+		}
+		if !reserved {
+			return tunnelID, nil
+		}
+	}
 }
 
-// handleTCPTunnel is now updated with fine-grained locking.
-func (s *Server) handleTCPTunnel(session *yamux.Session, ctrlStream net.Conn, user *github.User) {
+// requestedSubdomain maps a requested subdomain into the namespace of login: "api"
+// becomes "api-<login>", while "<login>" and "*-<login>" are already owned and kept as is.
+func requestedSubdomain(requested, login string) (string, error) {
+	name := strings.ToLower(strings.TrimSpace(requested))
+	if name != login && !strings.HasSuffix(name, "-"+login) {
+		name = fmt.Sprintf("%s-%s", name, login)
+	}
+	if len(name) > 63 || !subdomainPattern.MatchString(name) {
+		return "", fmt.Errorf("subdomain %q is not allowed, use lowercase letters, digits and dashes (max 63 characters)", requested)
+	}
+	return name, nil
+}
+
+// handleTCPTunnel is now updated with fine-grained locking. allocMutex is held
+// from the limit check to the registration, so parallel sessions of a user cannot
+// both pass the check.
+func (s *Server) handleTCPTunnel(sess *Session, req *tunnel.TunnelRequest) {
 	s.logger.LogInfoMessage().Msg("Handling TCP tunnel request...")
+	user := sess.user
 
-	s.mutex.Lock()
+	s.allocMutex.Lock()
+	defer s.allocMutex.Unlock()
 
-	userRecord, exists := s.users[user.Login]
-	if !exists {
-		userRecord = &User{
-			tunnels:   make(map[string]*Client),
-			maxTunnel: 2,
-		}
-		s.users[user.Login] = userRecord
-	}
+	s.mutex.Lock()
 
-	if len(userRecord.tunnels) >= userRecord.maxTunnel {
+	resumed := s.resumedTunnel(req.ResumeToken, user.Login, "tcp")
+	userRecord := s.userRecord(sess)
+	if limit, open := userRecord.tunnelLimit("tcp"); limit > 0 && open >= limit {
 		s.mutex.Unlock() // Unlock before returning
-		msg := fmt.Sprintf("err: max tcp tunnel limit reached (%d)", userRecord.maxTunnel)
-		ctrlStream.Write([]byte(msg + "\n"))
-		s.logger.LogWarnMessage().Msgf("Max tunnel limit reached for user: %v", user.Login)
+		sess.ctrl.Send(tunnel.NewError(tunnel.ErrTunnelLimit, "max TCP tunnel limit of the %s plan reached (%d)", sess.plan.Name, limit))
+		s.logger.LogWarnMessage().Msgf("Max TCP tunnel limit reached for user: %v", user.Login)
 		return
 	}
-
-	// Get the port number and release the lock
-	port := s.nextTCPPort
-	s.nextTCPPort++
+	port := req.RemotePort
+	if resumed != nil {
+		port = resumed.port
+		s.releaseHeld(resumed)
+		s.logger.LogInfoMessage().Msgf("Resuming TCP tunnel on port %d for %s", port, user.Login)
+	}
 
 	s.mutex.Unlock()
 
+	if resumed == nil && port != 0 {
+		reservation, err := s.reservations.lookup(tunnel.ReservationTCPPort, fmt.Sprint(port))
+		if err != nil {
+			s.logger.LogErrorMessage().Err(err).Msg("Failed to look up port reservation")
+			sess.ctrl.Send(tunnel.NewError(tunnel.ErrInternal, "could not check port reservation"))
+			return
+		}
+		if reservation == nil || reservation.Owner != user.Login {
+			sess.ctrl.Send(tunnel.NewError(tunnel.ErrPortNotAllowed, "port %d is not reserved for %s, reserve one with `zaptun-client reserve tcp`", port, user.Login))
+			return
+		}
+	} else if port == 0 {
+		var err error
+		if port, err = s.allocateTCPPort(); err != nil {
+			s.logger.LogErrorMessage().Err(err).Msg("Failed to allocate TCP port")
+			sess.ctrl.Send(tunnel.NewError(tunnel.ErrPortUnavailable, "could not allocate public port"))
+			return
+		}
+	}
+
 	publicAddr := fmt.Sprintf("0.0.0.0:%d", port)
 	listener, err := net.Listen("tcp", publicAddr)
 	if err != nil {
-		ctrlStream.Write([]byte("error: could not allocate public port\n"))
+		sess.ctrl.Send(tunnel.NewError(tunnel.ErrPortUnavailable, "could not allocate public port"))
 		return
 	}
 	s.logger.LogInfoMessage().Msgf("TCP tunnel for %s listening on %s", user.Login, publicAddr)
 
-	tunnelID := fmt.Sprintf("tcp-%s-%d", user.Login, len(userRecord.tunnels)+1)
+	tunnelID := fmt.Sprintf("tcp-%s-%d", user.Login, port)
 	newClient := &Client{
-		id:       tunnelID,
-		session:  session,
-		listener: listener,
+		id:          tunnelID,
+		tunnelType:  "tcp",
+		session:     sess,
+		listener:    listener,
+		port:        port,
+		resumeToken: newResumeToken(),
 	}
 
 	s.mutex.Lock()
-	s.users[user.Login].tunnels[tunnelID] = newClient
+	s.registerTunnel(newClient)
 	s.mutex.Unlock()
 
-	// Defer cleanup
-	defer func() {
-		s.mutex.Lock()
-		if userRec, ok := s.users[user.Login]; ok {
-			delete(userRec.tunnels, tunnelID)
-			if len(userRec.tunnels) == 0 {
-				delete(s.users, user.Login)
-			}
-		}
-		s.mutex.Unlock()
-		session.Close()
-		listener.Close()
-		s.logger.LogInfoMessage().Msgf("Client tunnel %v disconnected. Closed public listener on %s.", tunnelID, publicAddr)
-	}()
-
 	publicURL := fmt.Sprintf("%s:%d", s.conf.Domain, port)
-	if _, err := ctrlStream.Write([]byte(publicURL + "\n")); err != nil {
+	err = sess.ctrl.Send(&tunnel.Message{
+		Type:           tunnel.MsgTunnelAssigned,
+		TunnelAssigned: &tunnel.TunnelAssigned{TunnelID: tunnelID, Type: "tcp", PublicAddr: publicURL, ResumeToken: newClient.resumeToken},
+	})
+	if err != nil {
 		s.logger.LogErrorMessage().Err(err).Msg("Failed to send assigned URL to client")
 		return
 	}
 
-	go s.proxyTCP(listener, session)
-	io.Copy(io.Discard, ctrlStream)
+	go s.proxyTCP(newClient)
 }
 
-// proxyTCP accepts public connections and forwards them to the client via yamux streams.
-func (s *Server) proxyTCP(listener net.Listener, session *yamux.Session) {
+// allocateTCPPort hands out the next public port that nobody has reserved and
+// that is not held for a resuming tunnel.
+func (s *Server) allocateTCPPort() (int, error) {
+	for {
+		s.mutex.Lock()
+		port := s.nextTCPPort
+		s.nextTCPPort++
+		held := s.heldPort(port) != nil
+		s.mutex.Unlock()
+		if held {
+			continue
+		}
+		reserved, err := s.reservations.lookup(tunnel.ReservationTCPPort, fmt.Sprint(port))
+		if err != nil {
+			return 0, err
+		}
+		if reserved == nil {
+			return port, nil
+		}
+	}
+}
+
+// proxyTCP accepts public connections and forwards them to the client via mux streams.
+func (s *Server) proxyTCP(client *Client) {
 	for {
 		// Accept a new connection from the public internet
-		publicConn, err := listener.Accept()
+		publicConn, err := client.listener.Accept()
 		if err != nil {
-			s.logger.LogWarnMessage().Err(err).Msg("Public TCP listener failed to accept")
+			if !errors.Is(err, net.ErrClosed) {
+				s.logger.LogWarnMessage().Err(err).Msg("Public TCP listener failed to accept")
+			}
 			return
 		}
 
 		s.logger.LogInfoMessage().Msgf("Accepted new public TCP connection from %s", publicConn.RemoteAddr())
 
+		login := client.session.user.Login
+		userRec, ok := s.acquireStream(client)
+		if !ok {
+			s.logger.LogWarnMessage().Msgf("Stream limit of the %s plan reached for %s, dropping connection", client.session.plan.Name, login)
+			publicConn.Close()
+			continue
+		}
+
 		// For each public connection, open a new stream to the client
-		proxyStream, err := session.OpenStream()
+		proxyStream, err := client.session.mux.OpenStream()
 		if err != nil {
-			s.logger.LogErrorMessage().Err(err).Msg("Failed to open yamux stream for TCP proxy")
+			s.logger.LogErrorMessage().Err(err).Msg("Failed to open mux stream for TCP proxy")
+			publicConn.Close()
+			s.releaseStream(login, userRec)
+			continue
+		}
+		if err := tunnel.WriteStreamHeader(proxyStream, &tunnel.StreamHeader{
+			TunnelID:    client.id,
+			Protocol:    "tcp",
+			VisitorAddr: publicConn.RemoteAddr().String(),
+			RequestID:   tunnel.NewRequestID(),
+		}); err != nil {
+			s.logger.LogErrorMessage().Err(err).Msg("Failed to write stream header for TCP proxy")
+			proxyStream.Close()
 			publicConn.Close()
+			s.releaseStream(login, userRec)
 			continue
 		}
 
-		// copy the data concurrently
+		// copy the data concurrently; the connection counts as in-flight for a
+		// graceful shutdown until both directions are done
+		if !s.beginStreams(2) {
+			proxyStream.Close()
+			publicConn.Close()
+			s.releaseStream(login, userRec)
+			return
+		}
+		var copies sync.WaitGroup
+		copies.Add(2)
+		go func() {
+			copies.Wait()
+			s.releaseStream(login, userRec)
+		}()
 		go func() {
+			defer s.streams.Done()
+			defer copies.Done()
 			defer proxyStream.Close()
 			defer publicConn.Close()
-			io.Copy(proxyStream, publicConn)
+			io.Copy(userRec.throttle(proxyStream), publicConn)
 		}()
 		go func() {
+			defer s.streams.Done()
+			defer copies.Done()
 			defer proxyStream.Close()
 			defer publicConn.Close()
-			io.Copy(publicConn, proxyStream)
+			io.Copy(userRec.throttle(publicConn), proxyStream)
 		}()
 	}
 }
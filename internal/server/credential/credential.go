@@ -0,0 +1,215 @@
+// Package credential issues and verifies zaptun session credentials: short-lived,
+// server-signed tokens that stand in for the identity provider's token after the
+// first connect, so the provider token is only sent again to renew them.
+//
+// A credential is "ztc_" + base64url(claims JSON) + "." + base64url(HMAC-SHA256).
+// Verification is local and never calls the identity provider.
+package credential
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/harsh082ip/ZapTun/internal/server/github"
+	"github.com/harsh082ip/ZapTun/pkg/db/redis"
+	"github.com/harsh082ip/ZapTun/pkg/tunnel"
+)
+
+const (
+	// Prefix marks a token as a zaptun credential rather than a provider token.
+	Prefix = tunnel.CredentialPrefix
+
+	// ScopeTunnel allows opening tunnels and managing reservations.
+	ScopeTunnel = "tunnel"
+
+	DefaultTTL = 7 * 24 * time.Hour
+	// DefaultMaxLifetime bounds how long a credential is renewed for, counted from
+	// the first credential issued for a provider login.
+	DefaultMaxLifetime = 30 * 24 * time.Hour
+
+	keyKey  = "zaptun:credential:key"
+	retries = 2
+)
+
+var (
+	// ErrExpired is returned for a well-formed credential past its expiry.
+	ErrExpired = fmt.Errorf("credential expired: %w", github.ErrInvalidToken)
+	errInvalid = fmt.Errorf("malformed or forged credential: %w", github.ErrInvalidToken)
+)
+
+// Claims is the signed content of a credential. User carries what authorization
+// needs (orgs, teams, account age) as it was when the credential was issued.
+type Claims struct {
+	ID         string      `json:"jti"` // machine token the credential belongs to
+	Login      string      `json:"sub"`
+	Audience   string      `json:"aud"`
+	Scope      string      `json:"scope"`
+	IssuedAt   int64       `json:"iat"`
+	ExpiresAt  int64       `json:"exp"`
+	User       github.User `json:"usr"`
+	MaxTunnels int         `json:"max_tunnels,omitempty"`
+	Plan       string      `json:"plan,omitempty"`
+
+	// FirstIssuedAt is when the first credential of the chain of renewals this one
+	// belongs to was issued, zero for credentials issued before it was recorded
+	FirstIssuedAt int64 `json:"first_iat,omitempty"`
+}
+
+// Expiry returns when the credential stops being valid.
+func (c *Claims) Expiry() time.Time {
+	return time.Unix(c.ExpiresAt, 0)
+}
+
+// firstIssued returns when the chain of renewals of the credential started.
+func (c *Claims) firstIssued() time.Time {
+	if c.FirstIssuedAt == 0 {
+		return time.Unix(c.IssuedAt, 0)
+	}
+	return time.Unix(c.FirstIssuedAt, 0)
+}
+
+// Issuer signs and verifies credentials for one audience, normally the server's domain.
+type Issuer struct {
+	key         []byte
+	audience    string
+	ttl         time.Duration
+	maxLifetime time.Duration
+}
+
+// NewIssuer returns an issuer signing with key. A zero ttl means DefaultTTL and a
+// zero maxLifetime DefaultMaxLifetime.
+func NewIssuer(key []byte, audience string, ttl, maxLifetime time.Duration) *Issuer {
+	if ttl <= 0 {
+		ttl = DefaultTTL
+	}
+	if maxLifetime <= 0 {
+		maxLifetime = DefaultMaxLifetime
+	}
+	return &Issuer{key: key, audience: audience, ttl: ttl, maxLifetime: maxLifetime}
+}
+
+// LoadKey returns the signing key: secret when configured, otherwise a random key
+// kept in kv, so every server sharing the store accepts the same credentials. A
+// key kept in an in-memory store is lost on restart, together with every
+// credential signed with it.
+func LoadKey(kv redis.RedisStoreWithRetries, secret string) ([]byte, error) {
+	if secret != "" {
+		return []byte(secret), nil
+	}
+	// SetNX only creates the key if no other server got there first; the value is
+	// JSON quoted so it reads back with GetJSON
+	generated := make([]byte, 32)
+	if _, err := rand.Read(generated); err != nil {
+		return nil, err
+	}
+	if _, err := kv.AcquireLockWithMaxRetries(keyKey, strconv.Quote(hex.EncodeToString(generated)), 0, retries); err != nil {
+		return nil, fmt.Errorf("error storing credential key: %w", err)
+	}
+	var stored string
+	if err := kv.GetJSONWithMaxRetries(keyKey, &stored, retries); err != nil {
+		return nil, fmt.Errorf("error loading credential key: %w", err)
+	}
+	return hex.DecodeString(stored)
+}
+
+// IsCredential reports whether token looks like a zaptun credential.
+func IsCredential(token string) bool {
+	return strings.HasPrefix(token, Prefix)
+}
+
+// TTL returns how long newly issued credentials are valid.
+func (i *Issuer) TTL() time.Duration {
+	return i.ttl
+}
+
+// Renewable reports whether a credential renewed from claims would outlive
+// them, which it cannot once the chain reaches the maximum lifetime.
+func (i *Issuer) Renewable(claims *Claims) bool {
+	return claims.firstIssued().Add(i.maxLifetime).Unix() > claims.ExpiresAt
+}
+
+// Issue returns a credential for user and the machine token id, valid for the
+// issuer's TTL. previous is the credential it renews, nil for a new login; a
+// renewal expires at most the maximum lifetime after the first credential.
+func (i *Issuer) Issue(user github.User, id string, previous *Claims) (string, *Claims, error) {
+	now := time.Now()
+	first := now
+	if previous != nil {
+		first = previous.firstIssued()
+	}
+	expires := now.Add(i.ttl)
+	if limit := first.Add(i.maxLifetime); expires.After(limit) {
+		expires = limit
+	}
+	claims := &Claims{
+		ID:            id,
+		Login:         user.Login,
+		Audience:      i.audience,
+		Scope:         ScopeTunnel,
+		IssuedAt:      now.Unix(),
+		ExpiresAt:     expires.Unix(),
+		FirstIssuedAt: first.Unix(),
+		User:          user,
+		MaxTunnels:    user.MaxTunnels,
+		Plan:          user.Plan,
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", nil, err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return Prefix + encoded + "." + base64.RawURLEncoding.EncodeToString(i.sign(encoded)), claims, nil
+}
+
+func (i *Issuer) sign(encoded string) []byte {
+	mac := hmac.New(sha256.New, i.key)
+	mac.Write([]byte(encoded))
+	return mac.Sum(nil)
+}
+
+// Verify checks the signature, audience, scope and expiry of token and returns
+// the user it was issued for. Errors wrap github.ErrInvalidToken.
+func (i *Issuer) Verify(token string) (github.User, *Claims, error) {
+	encoded, sig, ok := strings.Cut(strings.TrimPrefix(token, Prefix), ".")
+	if !IsCredential(token) || !ok {
+		return github.User{}, nil, errInvalid
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(mac, i.sign(encoded)) {
+		return github.User{}, nil, errInvalid
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return github.User{}, nil, errInvalid
+	}
+	var claims Claims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return github.User{}, nil, errInvalid
+	}
+	if claims.Audience != i.audience || claims.Scope != ScopeTunnel || claims.Login == "" {
+		return github.User{}, nil, errInvalid
+	}
+	// the maximum lifetime also covers credentials issued before it was lowered
+	if now := time.Now(); now.After(claims.Expiry()) || now.After(claims.firstIssued().Add(i.maxLifetime)) {
+		return github.User{}, nil, ErrExpired
+	}
+	user := claims.User
+	user.Login = claims.Login
+	user.MaxTunnels = claims.MaxTunnels
+	user.Plan = claims.Plan
+	return user, &claims, nil
+}
+
+// IsExpired reports whether err means the credential was valid but is too old.
+func IsExpired(err error) bool {
+	return errors.Is(err, ErrExpired)
+}
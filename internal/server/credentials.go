@@ -0,0 +1,154 @@
+package server
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/harsh082ip/ZapTun/internal/server/credential"
+	"github.com/harsh082ip/ZapTun/internal/server/github"
+	"github.com/harsh082ip/ZapTun/pkg/tunnel"
+)
+
+var (
+	// errTokenRevoked is returned for a valid credential whose machine token is gone.
+	errTokenRevoked = fmt.Errorf("machine token was revoked: %w", github.ErrInvalidToken)
+	// errLoginRevoked is returned when the identity provider no longer accepts the
+	// login a credential due for renewal was issued for.
+	errLoginRevoked = fmt.Errorf("identity provider revoked the login: %w", github.ErrInvalidToken)
+)
+
+// credentialsEnabled reports whether clients are issued session credentials. They
+// stand in for provider logins only: an API key is checked locally anyway, and a
+// credential would keep a deleted key working until it expired. Without Redis the
+// signing key and the machine tokens would not survive a restart, which would
+// reject every credential issued before it.
+func (s *Server) credentialsEnabled() bool {
+	if s.conf.DisableCredentials {
+		return false
+	}
+	switch s.conf.AuthBackend {
+	case "", "github", "oidc":
+	default:
+		return false
+	}
+	if s.conf.RedisAddr == "" {
+		s.logger.LogWarnMessage().Msg("No redis_addr configured, session credentials are disabled")
+		return false
+	}
+	return true
+}
+
+// authenticate identifies the client of a new session. A client certificate,
+// already verified during the TLS handshake, takes precedence over the token of
+// the Hello. Session credentials are verified locally, any other token goes to
+// the configured authenticator. claims and token are nil unless the Hello carried
+// a credential; token is nil as well for credentials issued before machine tokens.
+func (s *Server) authenticate(presented string, peerCerts []*x509.Certificate) (github.User, *credential.Claims, *tunnel.TokenInfo, error) {
+	if s.certAuth != nil && len(peerCerts) > 0 {
+		user, err := s.certAuth.AuthenticateCertificate(peerCerts[0])
+		return user, nil, nil, err
+	}
+	if !credential.IsCredential(presented) {
+		user, err := s.authenticator.Authenticate(presented)
+		return user, nil, nil, err
+	}
+	if s.credentials == nil {
+		return github.User{}, nil, nil, fmt.Errorf("session credentials are disabled on this server")
+	}
+	user, claims, err := s.credentials.Verify(presented)
+	if err != nil || claims.ID == "" {
+		return user, claims, nil, err
+	}
+	token, err := s.tokens.lookup(user.Login, claims.ID)
+	if err != nil {
+		return github.User{}, nil, nil, err
+	}
+	if token == nil {
+		return github.User{}, nil, nil, errTokenRevoked
+	}
+	return user, claims, token, nil
+}
+
+// refreshLogin checks the login of a credential due for renewal with the identity
+// provider again, using the provider token the client sent along, so revoked
+// logins and changed orgs and teams take effect. It returns the user as the
+// provider sees it now and whether the credential is to be renewed; without a
+// provider token, past the maximum lifetime or while the provider is unreachable
+// the credential is kept until it expires.
+func (s *Server) refreshLogin(user github.User, claims *credential.Claims, providerToken string) (github.User, bool, error) {
+	if s.credentials == nil || claims == nil || time.Until(claims.Expiry()) > s.credentials.TTL()/2 {
+		return user, false, nil
+	}
+	if providerToken == "" || credential.IsCredential(providerToken) || !s.credentials.Renewable(claims) {
+		return user, false, nil
+	}
+	fresh, err := s.authenticator.Authenticate(providerToken)
+	if errors.Is(err, github.ErrInvalidToken) || (err == nil && fresh.Login != user.Login) {
+		return github.User{}, false, errLoginRevoked
+	}
+	if err != nil {
+		s.logger.LogWarnMessage().Err(err).Msgf("Could not check the login of %s again, not renewing its credential", user.Login)
+		return user, false, nil
+	}
+	return fresh, true, nil
+}
+
+// tokenRejected is the error sent for an expired or revoked credential.
+func tokenRejected(err error) *tunnel.Message {
+	reason, message := tunnel.AuthTokenRevoked, "this machine's token was revoked"
+	if credential.IsExpired(err) {
+		reason, message = tunnel.AuthTokenExpired, "your session credential expired"
+	} else if errors.Is(err, errLoginRevoked) {
+		message = "the identity provider no longer accepts your login"
+	}
+	return &tunnel.Message{Type: tunnel.MsgError, Error: &tunnel.Error{
+		Code:    tunnel.ErrAuthFailed,
+		Reason:  reason,
+		Message: message + ", log in again with `zaptun-client auth login`",
+	}}
+}
+
+// issueCredential records the use of the session's machine token, creating one
+// named machineName for clients that authenticated with a provider token, and
+// adds a session credential to result when the client has none yet or renew is
+// set, see refreshLogin. It returns the machine token ID.
+func (s *Server) issueCredential(result *tunnel.AuthResult, user github.User, claims *credential.Claims, token *tunnel.TokenInfo, machineName string, renew bool) string {
+	if s.credentials == nil {
+		return ""
+	}
+	now := time.Now().UTC()
+	isNew := token == nil
+	if isNew {
+		if machineName == "" {
+			machineName = "unnamed"
+		}
+		token = &tunnel.TokenInfo{ID: newTokenID(), Name: machineName, CreatedAt: now}
+	}
+	token.LastUsedAt = now
+
+	if claims == nil || isNew || renew {
+		cred, issued, err := s.credentials.Issue(user, token.ID, claims)
+		if err != nil {
+			s.logger.LogErrorMessage().Err(err).Msgf("Failed to issue credential for %s", user.Login)
+			return ""
+		}
+		token.ExpiresAt = issued.Expiry().UTC()
+		result.Credential = cred
+		result.CredentialExpiresAt = issued.ExpiresAt
+	}
+	if err := s.tokens.save(user.Login, token, isNew); err != nil {
+		// a credential for a token that was never stored would be rejected as revoked
+		s.logger.LogErrorMessage().Err(err).Msgf("Failed to store machine token of %s", user.Login)
+		result.Credential, result.CredentialExpiresAt = "", 0
+		if isNew {
+			return ""
+		}
+	}
+	if result.Credential != "" {
+		s.logger.LogDebugMessage().Msgf("Issued credential for %s (token %s, %q) valid until %s",
+			user.Login, token.ID, token.Name, token.ExpiresAt.Format(time.RFC3339))
+	}
+	return token.ID
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/harsh082ip/ZapTun/config"
+	"github.com/harsh082ip/ZapTun/internal/server/credential"
+	"github.com/harsh082ip/ZapTun/internal/server/github"
+	"github.com/harsh082ip/ZapTun/pkg/db/redis"
+	log "github.com/harsh082ip/ZapTun/pkg/logger"
+	"github.com/rs/zerolog"
+)
+
+func newTestServer(conf *config.ServerConfig) *Server {
+	return NewServer(conf, log.NewLogger(io.Discard, zerolog.Disabled, "test"), nil, redis.NewMemoryStore())
+}
+
+func TestCredentialsEnabled(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		conf config.ServerConfig
+		want bool
+	}{
+		{"github with redis", config.ServerConfig{RedisAddr: "localhost:6379"}, true},
+		{"oidc with redis", config.ServerConfig{AuthBackend: "oidc", RedisAddr: "localhost:6379"}, true},
+		{"disabled", config.ServerConfig{RedisAddr: "localhost:6379", DisableCredentials: true}, false},
+		// the key and the machine tokens would be gone after a restart
+		{"memory store", config.ServerConfig{CredentialSecret: "secret"}, false},
+		// a deleted key must stop working at once
+		{"apikey_kv", config.ServerConfig{AuthBackend: "apikey_kv", RedisAddr: "localhost:6379"}, false},
+		{"apikey_file", config.ServerConfig{AuthBackend: "apikey_file", RedisAddr: "localhost:6379"}, false},
+	} {
+		conf := tc.conf
+		s := newTestServer(&conf)
+		if got := s.credentialsEnabled(); got != tc.want {
+			t.Errorf("%s: credentialsEnabled() = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+// fakeProvider answers Authenticate with user and err, counting the calls.
+type fakeProvider struct {
+	user  github.User
+	err   error
+	calls int
+}
+
+func (p *fakeProvider) GetOAuthUrl(state string) string                  { return "" }
+func (p *fakeProvider) ExchangeCodeForToken(code string) (string, error) { return "", nil }
+func (p *fakeProvider) Authenticate(token string) (github.User, error) {
+	p.calls++
+	return p.user, p.err
+}
+
+func TestRefreshLogin(t *testing.T) {
+	s := newTestServer(&config.ServerConfig{})
+	s.credentials = credential.NewIssuer([]byte("key"), "test", time.Hour, 24*time.Hour)
+	alice := github.User{Login: "alice", Allowed: true, Orgs: []string{"old"}}
+	_, claims, err := s.credentials.Issue(alice, "t1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := &fakeProvider{user: github.User{Login: "alice", Allowed: true, Orgs: []string{"new"}}}
+	s.authenticator = provider
+
+	if _, renew, err := s.refreshLogin(alice, claims, "gho_alice"); renew || err != nil || provider.calls != 0 {
+		t.Errorf("fresh credential: renew = %v, %v after %d provider calls, want it kept", renew, err, provider.calls)
+	}
+
+	due := *claims
+	due.ExpiresAt = time.Now().Add(10 * time.Minute).Unix()
+	// older clients send no provider token, their credential runs out
+	if _, renew, err := s.refreshLogin(alice, &due, ""); renew || err != nil {
+		t.Errorf("due without provider token: renew = %v, %v, want it kept", renew, err)
+	}
+	user, renew, err := s.refreshLogin(alice, &due, "gho_alice")
+	if !renew || err != nil || len(user.Orgs) != 1 || user.Orgs[0] != "new" {
+		t.Errorf("due with provider token = %+v, %v, %v, want a renewal with the current orgs", user, renew, err)
+	}
+
+	provider.err = errors.New("provider unreachable")
+	if _, renew, err := s.refreshLogin(alice, &due, "gho_alice"); renew || err != nil {
+		t.Errorf("provider down: renew = %v, %v, want it kept", renew, err)
+	}
+	provider.err = github.ErrInvalidToken
+	if _, _, err := s.refreshLogin(alice, &due, "gho_alice"); !errors.Is(err, errLoginRevoked) {
+		t.Errorf("revoked at the provider: err = %v, want errLoginRevoked", err)
+	}
+	provider.user, provider.err = github.User{Login: "mallory", Allowed: true}, nil
+	if _, _, err := s.refreshLogin(alice, &due, "gho_mallory"); !errors.Is(err, errLoginRevoked) {
+		t.Errorf("provider token of another user: err = %v, want errLoginRevoked", err)
+	}
+
+	// at the maximum lifetime the provider is not even asked
+	provider.calls = 0
+	due.FirstIssuedAt = time.Now().Add(-24*time.Hour + 10*time.Minute).Unix()
+	if _, renew, err := s.refreshLogin(alice, &due, "gho_alice"); renew || err != nil || provider.calls != 0 {
+		t.Errorf("past the maximum lifetime: renew = %v, %v after %d provider calls, want it kept", renew, err, provider.calls)
+	}
+}
+
+func TestCredentialMaxLifetime(t *testing.T) {
+	issuer := credential.NewIssuer([]byte("key"), "test", 7*24*time.Hour, 30*24*time.Hour)
+	alice := github.User{Login: "alice", Allowed: true}
+	_, first, err := issuer.Issue(alice, "t1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// renewals keep the time of the first credential and never outlive it by more
+	// than the maximum lifetime
+	first.FirstIssuedAt = time.Now().Add(-29 * 24 * time.Hour).Unix()
+	_, renewed, err := issuer.Issue(alice, "t1", first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	limit := first.FirstIssuedAt + int64((30 * 24 * time.Hour).Seconds())
+	if renewed.FirstIssuedAt != first.FirstIssuedAt || renewed.ExpiresAt != limit {
+		t.Errorf("renewal = first %d, expiry %d, want first %d, expiry %d", renewed.FirstIssuedAt, renewed.ExpiresAt, first.FirstIssuedAt, limit)
+	}
+	if issuer.Renewable(renewed) {
+		t.Error("a credential at the maximum lifetime is renewable")
+	}
+
+	// a lowered maximum applies to credentials issued before
+	cred, _, _ := issuer.Issue(alice, "t1", first)
+	lowered := credential.NewIssuer([]byte("key"), "test", 7*24*time.Hour, 24*time.Hour)
+	if _, _, err := lowered.Verify(cred); !credential.IsExpired(err) {
+		t.Errorf("credential past the lowered maximum: err = %v, want expired", err)
+	}
+}
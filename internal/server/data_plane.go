@@ -2,24 +2,86 @@ package server
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
+	"mime"
+	"net"
 	"net/http"
 	"strings"
+	"sync"
+	"time"
+
+	"github.com/harsh082ip/ZapTun/pkg/tunnel"
 )
 
 func (s *Server) startDataPlane() {
-	s.logger.LogInfoMessage().Msgf("Data plane starting on %s", s.conf.DataPlaneAddr)
-
-	// The server's handler is our custom proxy.
+	// The server's handler is our custom proxy. It serves plain HTTP on
+	// DataPlaneAddr and HTTPS on DataPlaneTLSAddr, so one Shutdown drains both.
+	// Visitors may speak HTTP/2, negotiated with ALPN or with prior knowledge (h2c)
+	// on the plain listener; requests are relayed to the client as HTTP/1.1 with
+	// chunked bodies and trailers either way.
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(true)
+	protocols.SetUnencryptedHTTP2(true)
 	server := &http.Server{
-		Addr:    s.conf.DataPlaneAddr,
-		Handler: http.HandlerFunc(s.proxyHandler),
+		Handler:   http.HandlerFunc(s.proxyHandler),
+		Protocols: protocols,
+	}
+	if s.conf.DataPlaneTLSAddr != "" {
+		server.TLSConfig = &tls.Config{GetCertificate: s.certs.DataCertificate}
+	}
+
+	s.mutex.Lock()
+	if s.draining {
+		s.mutex.Unlock()
+		return
 	}
+	s.dataServer = server
+	s.mutex.Unlock()
 
-	if err := server.ListenAndServe(); err != nil {
-		s.logger.LogFatalMessage().Err(err).Msg("Data plane failed to start")
+	var wg sync.WaitGroup
+	serve := func(addr string, useTLS bool) {
+		defer wg.Done()
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			s.logger.LogFatalMessage().Err(err).Msg("Data plane failed to start")
+		}
+		if useTLS {
+			s.logger.LogInfoMessage().Msgf("Data plane starting on %s (HTTPS)", addr)
+			err = server.ServeTLS(listener, "", "")
+		} else {
+			s.logger.LogInfoMessage().Msgf("Data plane starting on %s", addr)
+			err = server.Serve(listener)
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.logger.LogFatalMessage().Err(err).Msg("Data plane failed")
+		}
+	}
+	if s.conf.DataPlaneAddr != "" {
+		wg.Add(1)
+		go serve(s.conf.DataPlaneAddr, false)
 	}
+	if s.conf.DataPlaneTLSAddr != "" {
+		wg.Add(1)
+		go serve(s.conf.DataPlaneTLSAddr, true)
+	}
+	wg.Wait()
+}
+
+// redirectToHTTPS sends a plain HTTP visitor to the same URL on the HTTPS listener.
+func (s *Server) redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if _, port, err := net.SplitHostPort(s.conf.DataPlaneTLSAddr); err == nil && port != "443" {
+		host = net.JoinHostPort(host, port)
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
 }
 
 func (s *Server) proxyHandler(w http.ResponseWriter, r *http.Request) {
@@ -34,26 +96,30 @@ func (s *Server) proxyHandler(w http.ResponseWriter, r *http.Request) {
 	// [note]: I am using nginx, that is routing user's request to my server, so all requests come from localhost.
 	// To get the actual user's IP, I need to read it from the X-Forwarded-For header set by Nginx.
 	// if u dont wish to use that, fallback will work for you
-	userIP := r.Header.Get("X-Forwarded-For")
-	if userIP == "" {
-		userIP = strings.Split(r.RemoteAddr, ":")[0] // fallback
+	visitorAddr, visitorTLS := visitorOf(r)
+	if visitorTLS == nil && s.conf.RedirectHTTPToHTTPS && s.conf.DataPlaneTLSAddr != "" {
+		s.redirectToHTTPS(w, r)
+		return
+	}
+	header := &tunnel.StreamHeader{
+		TunnelID:    tunnelID,
+		Protocol:    "http",
+		VisitorAddr: visitorAddr,
+		RequestID:   tunnel.NewRequestID(),
+		TLS:         visitorTLS,
 	}
 
-	r.Header.Set("X-Forwarded-For", userIP)
-
-	// 2. Extract the base username from the tunnel ID.
-	// This works for both "username" and "username-1".
-	userLogin := strings.Split(tunnelID, "-")[0]
+	if ip := header.VisitorIP(); ip != nil {
+		r.Header.Set("X-Forwarded-For", ip.String())
+	}
+	r.Header.Set("X-Forwarded-Proto", "http")
+	if visitorTLS != nil {
+		r.Header.Set("X-Forwarded-Proto", "https")
+	}
 
-	// 3. Perform the two-step lookup in the new 'users' map.
+	// 2. Look the tunnel up in the routing table.
 	s.mutex.RLock()
-	userRecord, userFound := s.users[userLogin]
-	var client *Client
-	var tunnelFound bool
-	if userFound {
-		// If the user exists, look for their specific tunnel.
-		client, tunnelFound = userRecord.tunnels[tunnelID]
-	}
+	client, tunnelFound := s.httpTunnels[tunnelID]
 	s.mutex.RUnlock()
 
 	if !tunnelFound {
@@ -62,8 +128,21 @@ func (s *Server) proxyHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, msg, http.StatusNotFound)
 		return
 	}
+	upgrade := tunnel.IsUpgrade(r.Header)
+	if upgrade && !tunnel.HasFeature(client.session.features, tunnel.FeatureUpgrade) {
+		http.Error(w, "The zaptun-client serving this tunnel is too old for WebSocket, it needs to be updated", http.StatusNotImplemented)
+		return
+	}
 
-	proxyStream, err := client.session.OpenStream()
+	userRec, ok := s.acquireStream(client)
+	if !ok {
+		s.logger.LogWarnMessage().Msgf("Stream limit of the %s plan reached for %s", client.session.plan.Name, client.session.user.Login)
+		http.Error(w, "Too many concurrent requests for this tunnel", http.StatusTooManyRequests)
+		return
+	}
+	defer s.releaseStream(client.session.user.Login, userRec)
+
+	proxyStream, err := client.session.mux.OpenStream()
 	if err != nil {
 		msg := fmt.Sprintf("failed to open stream for client_id: %v, err: %v", tunnelID, err)
 		http.Error(w, msg, http.StatusInternalServerError)
@@ -71,15 +150,61 @@ func (s *Server) proxyHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	defer proxyStream.Close()
+	// a visitor that goes away closes the stream, which tells the client to drop its
+	// connection to the local service, e.g. to end an event stream or a long poll
+	stop := context.AfterFunc(r.Context(), func() { proxyStream.Close() })
+	defer stop()
 
-	s.logger.LogInfoMessage().Str("host", r.Host).Str("path", r.URL.Path).Msg("Proxying request")
-
-	if err := r.Write(proxyStream); err != nil {
-		s.logger.LogErrorMessage().Err(err).Msgf("Failed to write request to proxy stream for client %s", tunnelID)
+	if err := tunnel.WriteStreamHeader(proxyStream, header); err != nil {
+		s.logger.LogErrorMessage().Err(err).Msgf("Failed to write stream header for client %s", tunnelID)
+		http.Error(w, "Error reaching client service", http.StatusBadGateway)
 		return
 	}
 
-	resp, err := http.ReadResponse(bufio.NewReader(proxyStream), r)
+	s.logger.LogInfoMessage().Str("host", r.Host).Str("path", r.URL.Path).Str("request_id", header.RequestID).Msg("Proxying request")
+
+	// the request is written while the response is read, so a response can stream
+	// back before the visitor finished sending, as gRPC bidirectional streams need;
+	// HTTP/1 only allows that once full duplex is enabled
+	rc := http.NewResponseController(w)
+	if r.ProtoMajor == 1 {
+		rc.EnableFullDuplex()
+	}
+	writeCtx, stopWrite := context.WithCancel(r.Context())
+	requestWritten := make(chan struct{})
+	go func() {
+		defer close(requestWritten)
+		if err := r.Write(userRec.throttle(proxyStream)); err != nil {
+			if writeCtx.Err() == nil {
+				s.logger.LogErrorMessage().Err(err).Msgf("Failed to write request to proxy stream for client %s", tunnelID)
+			}
+			proxyStream.Close()
+		}
+	}()
+	// the request body must not be touched after the handler returned
+	defer func() {
+		stopWrite()
+		proxyStream.Close()
+		select {
+		case <-requestWritten:
+		default:
+			// the visitor is still sending a body nobody reads any more; closing an
+			// HTTP/1 body waits for the read, so that read is timed out instead
+			if r.ProtoMajor == 1 {
+				rc.SetReadDeadline(time.Now())
+			} else {
+				r.Body.Close()
+			}
+			<-requestWritten
+		}
+	}()
+
+	streamReader := bufio.NewReader(proxyStream)
+	resp, err := http.ReadResponse(streamReader, r)
+	if err != nil && r.Context().Err() != nil {
+		s.logger.LogInfoMessage().Msgf("Visitor of %s went away before the response", tunnelID)
+		return
+	}
 	if err != nil {
 		http.Error(w, "Error reading response from client service", http.StatusBadGateway)
 		s.logger.LogErrorMessage().Err(err).Msgf("Failed to read response from proxy stream for client %s", tunnelID)
@@ -87,12 +212,139 @@ func (s *Server) proxyHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer resp.Body.Close()
 
+	if upgrade && resp.StatusCode == http.StatusSwitchingProtocols {
+		<-requestWritten
+		s.proxyUpgrade(w, resp, proxyStream, streamReader, userRec, tunnelID)
+		return
+	}
+
 	for key, values := range resp.Header {
 		for _, value := range values {
 			w.Header().Add(key, value)
 		}
 	}
+	// they describe the connection to the client, not the one to the visitor
+	for _, key := range tunnel.HopHeaders {
+		w.Header().Del(key)
+	}
+
+	// trailers are announced now and sent once the body is done
+	announced := make(map[string]bool)
+	for key := range resp.Trailer {
+		w.Header().Add("Trailer", key)
+		announced[key] = true
+	}
 
+	var body io.Writer = w
+	streaming := isStreaming(resp)
+	if streaming {
+		// no buffering in a reverse proxy in front of the server either
+		w.Header().Set("X-Accel-Buffering", "no")
+		body = flushWriter{w: w, rc: rc}
+	}
 	w.WriteHeader(resp.StatusCode)
-	io.Copy(w, resp.Body)
+	if streaming {
+		rc.Flush()
+	}
+	io.Copy(userRec.throttle(body), resp.Body)
+
+	for key, values := range resp.Trailer {
+		if !announced[key] {
+			// e.g. grpc-status, which gRPC servers send without announcing it
+			key = http.TrailerPrefix + key
+		}
+		w.Header()[key] = values
+	}
+}
+
+// isStreaming reports whether resp is delivered piecemeal, like Server-Sent Events
+// and chunked responses of unknown length. Those are flushed to the visitor as
+// they arrive rather than when the response buffer fills.
+func isStreaming(resp *http.Response) bool {
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return mediaType == "text/event-stream" || resp.ContentLength < 0
+}
+
+// flushWriter flushes the response after every write.
+type flushWriter struct {
+	w  io.Writer
+	rc *http.ResponseController
+}
+
+func (fw flushWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	if err == nil {
+		err = fw.rc.Flush()
+	}
+	return n, err
+}
+
+// proxyUpgrade completes a protocol switch such as a WebSocket handshake: it hands
+// the 101 response to the visitor over the hijacked connection and then relays
+// raw bytes both ways until either side closes. streamReader may already hold
+// bytes the local service sent right after the response.
+func (s *Server) proxyUpgrade(w http.ResponseWriter, resp *http.Response, proxyStream net.Conn, streamReader *bufio.Reader, userRec *User, tunnelID string) {
+	// hijacked connections are not drained by the HTTP server, so they count as
+	// in-flight streams for a graceful shutdown like TCP connections
+	if !s.beginStreams(1) {
+		http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	defer s.streams.Done()
+	visitorConn, visitorBuf, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		s.logger.LogErrorMessage().Err(err).Msgf("Failed to take over visitor connection for client %s", tunnelID)
+		http.Error(w, "Error switching protocols", http.StatusInternalServerError)
+		return
+	}
+	defer visitorConn.Close()
+	if err := resp.Write(visitorConn); err != nil {
+		return
+	}
+	s.logger.LogInfoMessage().Msgf("Switched visitor of %s to %s", tunnelID, resp.Header.Get("Upgrade"))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer proxyStream.Close()
+		io.Copy(userRec.throttle(proxyStream), visitorBuf.Reader)
+	}()
+	io.Copy(userRec.throttle(visitorConn), streamReader)
+	visitorConn.Close()
+	<-done
+}
+
+// visitorOf returns the address of the visitor behind r and its TLS state. Requests
+// from a loopback address come from the reverse proxy in front of the server, which
+// reports the visitor in X-Forwarded-For and X-Forwarded-Proto; the last
+// X-Forwarded-For entry is the one the proxy added, earlier ones can be forged.
+func visitorOf(r *http.Request) (string, *tunnel.StreamTLS) {
+	var visitorTLS *tunnel.StreamTLS
+	if r.TLS != nil {
+		visitorTLS = &tunnel.StreamTLS{
+			Version:     tls.VersionName(r.TLS.Version),
+			CipherSuite: tls.CipherSuiteName(r.TLS.CipherSuite),
+			ServerName:  r.TLS.ServerName,
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr, visitorTLS
+	}
+	peer := net.ParseIP(host)
+	forwarded := r.Header.Values("X-Forwarded-For")
+	if peer == nil || !peer.IsLoopback() || len(forwarded) == 0 {
+		return r.RemoteAddr, visitorTLS
+	}
+
+	hops := strings.Split(forwarded[len(forwarded)-1], ",")
+	visitor := strings.TrimSpace(hops[len(hops)-1])
+	if net.ParseIP(visitor) == nil {
+		return r.RemoteAddr, visitorTLS
+	}
+	if visitorTLS == nil && strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https") {
+		visitorTLS = &tunnel.StreamTLS{}
+	}
+	return visitor, visitorTLS
 }
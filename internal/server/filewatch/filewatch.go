@@ -0,0 +1,101 @@
+// Package filewatch reloads files the server reads at startup, such as
+// certificates and the policy, so they can be changed without a restart. A
+// Watcher checks every registered file for changes and reloads all of them on
+// SIGHUP; the server runs a single one, so there is one signal handler and one
+// poller however many files are watched.
+package filewatch
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// PollInterval is how often files are checked for changes.
+const PollInterval = 5 * time.Second
+
+// Watcher calls the reload function of a set of files when they change.
+type Watcher struct {
+	interval time.Duration
+
+	mu      sync.Mutex
+	entries []*entry
+}
+
+// entry is a reload function and the files it reads.
+type entry struct {
+	paths  []string
+	mods   []time.Time
+	reload func()
+}
+
+func New() *Watcher {
+	return &Watcher{interval: PollInterval}
+}
+
+// Add calls reload whenever the modification time of one of paths changes, and
+// on SIGHUP.
+func (w *Watcher) Add(reload func(), paths ...string) {
+	e := &entry{paths: paths, mods: make([]time.Time, len(paths)), reload: reload}
+	e.changed()
+	w.mu.Lock()
+	w.entries = append(w.entries, e)
+	w.mu.Unlock()
+}
+
+// Run watches the files until ctx is done.
+func (w *Watcher) Run(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		forced := false
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			forced = true
+		case <-ticker.C:
+		}
+
+		w.mu.Lock()
+		entries := append([]*entry(nil), w.entries...)
+		w.mu.Unlock()
+		for _, e := range entries {
+			// record the new times first, a broken file is retried once it changes again
+			if e.changed() || forced {
+				e.reload()
+			}
+		}
+	}
+}
+
+// changed records the current modification times and reports whether any differs
+// from the last check.
+func (e *entry) changed() bool {
+	changed := false
+	for i, path := range e.paths {
+		mod := modTime(path)
+		if !mod.Equal(e.mods[i]) {
+			e.mods[i] = mod
+			changed = true
+		}
+	}
+	return changed
+}
+
+// modTime returns the modification time of path, zero if it cannot be read.
+func modTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
@@ -0,0 +1,91 @@
+package filewatch
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func writeFile(t *testing.T, path string, mod time.Time) {
+	if err := os.WriteFile(path, []byte("x"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, mod, mod); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestReloadsChangedFiles(t *testing.T) {
+	dir := t.TempDir()
+	cert, key, other := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"), filepath.Join(dir, "config.json")
+	start := time.Now().Add(-time.Hour)
+	for _, path := range []string{cert, key, other} {
+		writeFile(t, path, start)
+	}
+
+	w := &Watcher{interval: 10 * time.Millisecond}
+	var certReloads, otherReloads atomic.Int32
+	w.Add(func() { certReloads.Add(1) }, cert, key)
+	w.Add(func() { otherReloads.Add(1) }, other)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go w.Run(ctx)
+
+	time.Sleep(50 * time.Millisecond)
+	if certReloads.Load() != 0 || otherReloads.Load() != 0 {
+		t.Fatal("reloaded files that did not change")
+	}
+
+	writeFile(t, key, start.Add(time.Minute))
+	waitFor(t, "the certificate reload", func() bool { return certReloads.Load() == 1 })
+	time.Sleep(50 * time.Millisecond)
+	if n := certReloads.Load(); n != 1 {
+		t.Errorf("one change reloaded %d times", n)
+	}
+	if otherReloads.Load() != 0 {
+		t.Error("reloaded a file that did not change")
+	}
+
+	// a deleted file counts as a change, so its reload can report the error
+	os.Remove(other)
+	waitFor(t, "the reload of the removed file", func() bool { return otherReloads.Load() == 1 })
+}
+
+func TestReloadsEverythingOnSIGHUP(t *testing.T) {
+	// keep SIGHUP from ending the test before Run handles it
+	guard := make(chan os.Signal, 1)
+	signal.Notify(guard, syscall.SIGHUP)
+	defer signal.Stop(guard)
+
+	path := filepath.Join(t.TempDir(), "config.json")
+	writeFile(t, path, time.Now())
+	w := &Watcher{interval: time.Hour}
+	var first, second atomic.Int32
+	w.Add(func() { first.Add(1) }, path)
+	w.Add(func() { second.Add(1) }, path)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go w.Run(ctx)
+
+	// Run may not have subscribed yet, so signal until it reloads
+	waitFor(t, "the reload on SIGHUP", func() bool {
+		syscall.Kill(os.Getpid(), syscall.SIGHUP)
+		time.Sleep(10 * time.Millisecond)
+		return first.Load() > 0 && second.Load() > 0
+	})
+}
@@ -2,49 +2,111 @@ package github
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
+	"regexp"
 	"strings"
 )
 
 const tokenPrefix = "gho_"
 
+// DefaultAPIURL is the GitHub REST API used unless another one is configured,
+// e.g. for GitHub Enterprise.
+const DefaultAPIURL = "https://api.github.com"
+
+// ErrInvalidToken is wrapped by Authenticate errors that reject the token itself,
+// as opposed to failures to reach the identity provider.
+var ErrInvalidToken = errors.New("invalid token")
+
+var loginPattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,37}[a-z0-9])?$`)
+
+// ValidLogin reports whether login may be handed out by an authenticator. Logins
+// end up in subdomains and tunnel IDs, so they must be DNS labels.
+func ValidLogin(login string) bool {
+	return loginPattern.MatchString(login)
+}
+
 type User struct {
 	ID         int    `json:"id"`
 	Name       string `json:"name"`
 	Login      string `json:"login"`
 	Allowed    bool   `json:"allowed"`
 	JoinedDate string `json:"created_at"`
+	// MaxTunnels overrides the server's per-user tunnel limit when set by the authenticator
+	MaxTunnels int `json:"-"`
+	// Plan names the user's plan when the authenticator knows it
+	Plan string `json:"-"`
+	// Orgs and Teams ("org/team-slug") the user belongs to, as far as the token may see
+	Orgs  []string `json:"orgs,omitempty"`
+	Teams []string `json:"teams,omitempty"`
 }
 
 type Authenticator interface {
-	GetOAuthUrl() string
+	// GetOAuthUrl returns the authorization URL; state, when not empty, is passed
+	// back to the redirect URI unchanged
+	GetOAuthUrl(state string) string
 	ExchangeCodeForToken(code string) (string, error)
 	Authenticate(token string) (User, error)
 }
 
+// Endpoints are the GitHub URLs the authenticator talks to. Empty fields use
+// the public github.com defaults.
+type Endpoints struct {
+	WebURL      string // OAuth authorize and access token pages, https://github.com
+	APIURL      string // REST API, https://api.github.com
+	RedirectURI string // OAuth callback of the website
+}
+
+const (
+	DefaultWebURL      = "https://github.com"
+	DefaultRedirectURI = "https://zaptun.com/auth-callback"
+)
+
 type github struct {
 	clientId     string
 	clientSecret string
 	defaultScope string
+	webURL       string
+	apiURL       string
 	userEndpoint string
 	redirectUri  string
 }
 
 func New(clientId, clientSecret string) Authenticator {
+	return NewWithEndpoints(clientId, clientSecret, Endpoints{})
+}
+
+// NewWithEndpoints is like New but talks to the given GitHub endpoints.
+func NewWithEndpoints(clientId, clientSecret string, endpoints Endpoints) Authenticator {
+	if endpoints.WebURL == "" {
+		endpoints.WebURL = DefaultWebURL
+	}
+	if endpoints.APIURL == "" {
+		endpoints.APIURL = DefaultAPIURL
+	}
+	if endpoints.RedirectURI == "" {
+		endpoints.RedirectURI = DefaultRedirectURI
+	}
 	return github{
 		clientId:     clientId,
 		clientSecret: clientSecret,
-		defaultScope: "user:email",
-		userEndpoint: "https://api.github.com/user",
-		redirectUri:  "https://zaptun.com/auth-callback",
+		defaultScope: "user:email read:org",
+		webURL:       strings.TrimRight(endpoints.WebURL, "/"),
+		apiURL:       strings.TrimRight(endpoints.APIURL, "/"),
+		userEndpoint: strings.TrimRight(endpoints.APIURL, "/") + "/user",
+		redirectUri:  endpoints.RedirectURI,
 	}
 }
 
-func (g github) GetOAuthUrl() string {
-	return fmt.Sprintf("https://github.com/login/oauth/authorize?"+
-		"client_id=%s&redirect_uri=%s&scope=%s", g.clientId, url.QueryEscape(g.redirectUri), g.defaultScope)
+func (g github) GetOAuthUrl(state string) string {
+	oauthUrl := fmt.Sprintf("%s/login/oauth/authorize?"+
+		"client_id=%s&redirect_uri=%s&scope=%s", g.webURL, g.clientId, url.QueryEscape(g.redirectUri), url.QueryEscape(g.defaultScope))
+	if state != "" {
+		oauthUrl += "&state=" + url.QueryEscape(state)
+	}
+	return oauthUrl
 }
 
 func (g github) ExchangeCodeForToken(code string) (string, error) {
@@ -57,7 +119,7 @@ func (g github) ExchangeCodeForToken(code string) (string, error) {
 
 	req, err := http.NewRequest(
 		"POST",
-		"https://github.com/login/oauth/access_token",
+		g.webURL+"/login/oauth/access_token",
 		strings.NewReader(payload.Encode()))
 	if err != nil {
 		return "", fmt.Errorf("failed to perform http request: %v", err)
@@ -87,7 +149,7 @@ func (g github) ExchangeCodeForToken(code string) (string, error) {
 func (g github) Authenticate(token string) (User, error) {
 	user, err := g.authenticate(g.userEndpoint, token)
 	if err != nil {
-		return User{}, fmt.Errorf("error authenticating with token, err: %v", err)
+		return User{}, fmt.Errorf("error authenticating with token, err: %w", err)
 	}
 	return user, err
 }
@@ -105,7 +167,10 @@ func (g github) authenticate(endpoint, token string) (User, error) {
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
-		return user, fmt.Errorf("invalid token %v", token)
+		if resp.StatusCode == http.StatusUnauthorized {
+			return user, ErrInvalidToken
+		}
+		return user, fmt.Errorf("user endpoint returned http %d", resp.StatusCode)
 	}
 	err = json.NewDecoder(resp.Body).Decode(&user)
 	if err != nil {
@@ -113,5 +178,68 @@ func (g github) authenticate(endpoint, token string) (User, error) {
 	}
 	user.Login = strings.ToLower(user.Login)
 	user.Allowed = true
+
+	if user.Orgs, err = g.orgs(token); err != nil {
+		return user, err
+	}
+	if user.Teams, err = g.teams(token); err != nil {
+		return user, err
+	}
 	return user, nil
 }
+
+// get decodes the JSON answer of an authenticated API request into out. It reports
+// false without error when the token may not read the resource, e.g. because it
+// was issued without the read:org scope.
+func (g github) get(path, token string, out interface{}) (bool, error) {
+	req, _ := http.NewRequest("GET", g.apiURL+path, nil)
+	req.Header.Set("Authorization", fmt.Sprintf("token %s%s", tokenPrefix, token))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("request to %s failed: %v", path, err)
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusNotFound:
+		return false, nil
+	case resp.StatusCode != http.StatusOK:
+		return false, fmt.Errorf("%s returned http %d", path, resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return false, fmt.Errorf("failed to decode %s: %v", path, err)
+	}
+	return true, nil
+}
+
+// orgs returns the lowercased logins of the user's organizations.
+func (g github) orgs(token string) ([]string, error) {
+	var orgs []struct {
+		Login string `json:"login"`
+	}
+	if ok, err := g.get("/user/orgs?per_page=100", token, &orgs); !ok {
+		return nil, err
+	}
+	names := make([]string, len(orgs))
+	for i, o := range orgs {
+		names[i] = strings.ToLower(o.Login)
+	}
+	return names, nil
+}
+
+// teams returns the user's teams as lowercased "org/team-slug".
+func (g github) teams(token string) ([]string, error) {
+	var teams []struct {
+		Slug         string `json:"slug"`
+		Organization struct {
+			Login string `json:"login"`
+		} `json:"organization"`
+	}
+	if ok, err := g.get("/user/teams?per_page=100", token, &teams); !ok {
+		return nil, err
+	}
+	names := make([]string, len(teams))
+	for i, t := range teams {
+		names[i] = strings.ToLower(t.Organization.Login + "/" + t.Slug)
+	}
+	return names, nil
+}
@@ -0,0 +1,16 @@
+// Package netaddr groups client addresses for the limits the server and the
+// website keep per client.
+package netaddr
+
+import "net"
+
+// Group returns the key per-client limits are counted under for the IP host:
+// the IP itself, or its /64 network for IPv6, where a single client usually
+// controls the whole prefix. Anything that is not an IP is returned unchanged.
+func Group(host string) string {
+	ip := net.ParseIP(host)
+	if ip == nil || ip.To4() != nil {
+		return host
+	}
+	return ip.Mask(net.CIDRMask(64, 128)).String() + "/64"
+}
@@ -0,0 +1,17 @@
+package netaddr
+
+import "testing"
+
+func TestGroup(t *testing.T) {
+	for _, tc := range []struct{ host, want string }{
+		{"192.0.2.1", "192.0.2.1"},
+		{"2001:db8::1", "2001:db8::/64"},
+		{"2001:db8::2:0:0:1", "2001:db8::/64"},
+		{"2001:db8:0:1::1", "2001:db8:0:1::/64"},
+		{"not-an-ip", "not-an-ip"},
+	} {
+		if got := Group(tc.host); got != tc.want {
+			t.Errorf("Group(%q) = %q, want %q", tc.host, got, tc.want)
+		}
+	}
+}
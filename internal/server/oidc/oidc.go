@@ -0,0 +1,372 @@
+// Package oidc authenticates users with any OpenID Connect identity provider, such
+// as Keycloak or Dex. The website runs the authorization code flow and hands the
+// user the provider's ID token; the server verifies ID tokens locally against the
+// provider's published signing keys (JWKS), which are cached.
+//
+// The login is taken from LoginClaim, the subject (sub) by default: it is the only
+// claim every provider keeps unique and stable, while usernames may be changed or
+// reused. Subjects that are not valid logins are hashed into one, see subjectLogin.
+// The provider's groups become orgs, so policies and org plans apply to them.
+package oidc
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/harsh082ip/ZapTun/internal/server/github"
+)
+
+const (
+	// keys are refetched after keysTTL, or earlier when a token names an unknown
+	// key, but at most once per keysRefreshMin
+	keysTTL        = time.Hour
+	keysRefreshMin = time.Minute
+	clockSkew      = time.Minute
+
+	DefaultLoginClaim  = "sub"
+	DefaultGroupsClaim = "groups"
+
+	// subjectLoginLength characters of base32 keep 160 bits of the subject's hash
+	subjectLoginLength = 32
+)
+
+// loginEncoding spells hashes with lowercase letters and digits only.
+var loginEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+// subjectLogin returns the login of the user with subject sub. Keycloak's UUIDs
+// are valid logins as they are; the subjects of Dex, Okta or Azure AD are mixed
+// case or too long, and lowercasing them could give two users the same login, so
+// they are replaced by a hash.
+func subjectLogin(sub string) string {
+	if sub == "" || github.ValidLogin(sub) {
+		return sub
+	}
+	sum := sha256.Sum256([]byte(sub))
+	return loginEncoding.EncodeToString(sum[:])[:subjectLoginLength]
+}
+
+// Config describes the provider and this client of it.
+type Config struct {
+	Issuer       string // e.g. https://keycloak.example.com/realms/acme
+	ClientID     string
+	ClientSecret string // only needed for the code exchange on the website
+	RedirectURI  string // OAuth callback of the website
+	LoginClaim   string // ID token claim holding the login, DefaultLoginClaim if empty
+	GroupsClaim  string // ID token claim listing groups, DefaultGroupsClaim if empty
+}
+
+// discovery is the part of the provider's openid-configuration we use.
+type discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type provider struct {
+	conf   Config
+	client *http.Client
+
+	mu          sync.Mutex
+	discovery   *discovery
+	keys        map[string]crypto.PublicKey // by kid
+	keysFetched time.Time
+}
+
+// New returns an authenticator for the provider at conf.Issuer. Discovery happens
+// on first use, so the server starts even while the provider is unreachable.
+func New(conf Config) github.Authenticator {
+	conf.Issuer = strings.TrimRight(conf.Issuer, "/")
+	if conf.LoginClaim == "" {
+		conf.LoginClaim = DefaultLoginClaim
+	}
+	if conf.GroupsClaim == "" {
+		conf.GroupsClaim = DefaultGroupsClaim
+	}
+	return &provider{conf: conf, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (p *provider) getJSON(u string, out interface{}) error {
+	resp, err := p.client.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned http %d", u, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// discover returns the provider metadata, fetching it once.
+func (p *provider) discover() (*discovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+	var d discovery
+	if err := p.getJSON(p.conf.Issuer+"/.well-known/openid-configuration", &d); err != nil {
+		return nil, fmt.Errorf("oidc discovery failed: %w", err)
+	}
+	if strings.TrimRight(d.Issuer, "/") != p.conf.Issuer {
+		return nil, fmt.Errorf("oidc discovery returned issuer %q, expected %q", d.Issuer, p.conf.Issuer)
+	}
+	p.discovery = &d
+	return p.discovery, nil
+}
+
+func (p *provider) GetOAuthUrl(state string) string {
+	d, err := p.discover()
+	if err != nil {
+		return ""
+	}
+	q := url.Values{
+		"response_type": {"code"},
+		"client_id":     {p.conf.ClientID},
+		"redirect_uri":  {p.conf.RedirectURI},
+		"scope":         {"openid profile email"},
+	}
+	if state != "" {
+		q.Set("state", state)
+	}
+	return d.AuthorizationEndpoint + "?" + q.Encode()
+}
+
+// ExchangeCodeForToken redeems an authorization code and returns the verified ID
+// token, which is what clients authenticate with.
+func (p *provider) ExchangeCodeForToken(code string) (string, error) {
+	d, err := p.discover()
+	if err != nil {
+		return "", err
+	}
+	resp, err := p.client.PostForm(d.TokenEndpoint, url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.conf.RedirectURI},
+		"client_id":     {p.conf.ClientID},
+		"client_secret": {p.conf.ClientSecret},
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to perform token request: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to obtain token: http %d", resp.StatusCode)
+	}
+	var response struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return "", fmt.Errorf("failed to decode token response: %v", err)
+	}
+	if _, err := p.Authenticate(response.IDToken); err != nil {
+		return "", err
+	}
+	return response.IDToken, nil
+}
+
+// audience accepts both forms of the aud claim, a string or a list of strings.
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var single string
+	if err := json.Unmarshal(b, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(b, &list); err != nil {
+		return err
+	}
+	*a = list
+	return nil
+}
+
+func (a audience) contains(clientID string) bool {
+	for _, aud := range a {
+		if aud == clientID {
+			return true
+		}
+	}
+	return false
+}
+
+// Authenticate verifies an ID token and returns the user it was issued to.
+func (p *provider) Authenticate(token string) (github.User, error) {
+	claims, err := p.verify(token)
+	if err != nil {
+		return github.User{}, err
+	}
+	var standard struct {
+		Issuer    string   `json:"iss"`
+		Audience  audience `json:"aud"`
+		Expiry    int64    `json:"exp"`
+		NotBefore int64    `json:"nbf"`
+		Name      string   `json:"name"`
+	}
+	if err := json.Unmarshal(claims, &standard); err != nil {
+		return github.User{}, fmt.Errorf("malformed id token claims: %w", github.ErrInvalidToken)
+	}
+	now := time.Now()
+	switch {
+	case strings.TrimRight(standard.Issuer, "/") != p.conf.Issuer:
+		return github.User{}, fmt.Errorf("id token from issuer %q: %w", standard.Issuer, github.ErrInvalidToken)
+	case !standard.Audience.contains(p.conf.ClientID):
+		return github.User{}, fmt.Errorf("id token not issued for client %s: %w", p.conf.ClientID, github.ErrInvalidToken)
+	case now.After(time.Unix(standard.Expiry, 0).Add(clockSkew)):
+		return github.User{}, fmt.Errorf("id token expired: %w", github.ErrInvalidToken)
+	case standard.NotBefore != 0 && now.Add(clockSkew).Before(time.Unix(standard.NotBefore, 0)):
+		return github.User{}, fmt.Errorf("id token not valid yet: %w", github.ErrInvalidToken)
+	}
+
+	var all map[string]interface{}
+	json.Unmarshal(claims, &all)
+	login, _ := all[p.conf.LoginClaim].(string)
+	if p.conf.LoginClaim == "sub" {
+		login = subjectLogin(login)
+	} else {
+		// usernames are case-insensitive like GitHub logins
+		login = strings.ToLower(login)
+	}
+	if !github.ValidLogin(login) {
+		return github.User{}, fmt.Errorf("claim %s %q is not a valid login: %w", p.conf.LoginClaim, login, github.ErrInvalidToken)
+	}
+	user := github.User{Name: standard.Name, Login: login, Allowed: true}
+	groups, _ := all[p.conf.GroupsClaim].([]interface{})
+	for _, g := range groups {
+		if name, ok := g.(string); ok {
+			// Keycloak reports group paths such as /engineering
+			user.Orgs = append(user.Orgs, strings.ToLower(strings.TrimPrefix(name, "/")))
+		}
+	}
+	return user, nil
+}
+
+// verify checks the signature of a JWT and returns its claims.
+func (p *provider) verify(token string) ([]byte, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("id token is not a JWT: %w", github.ErrInvalidToken)
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(raw, &header) != nil {
+		return nil, fmt.Errorf("malformed id token header: %w", github.ErrInvalidToken)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed id token signature: %w", github.ErrInvalidToken)
+	}
+	key, err := p.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" || rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig) != nil {
+			return nil, fmt.Errorf("bad id token signature: %w", github.ErrInvalidToken)
+		}
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" || len(sig) != 64 ||
+			!ecdsa.Verify(k, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+			return nil, fmt.Errorf("bad id token signature: %w", github.ErrInvalidToken)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported id token algorithm %s: %w", header.Alg, github.ErrInvalidToken)
+	}
+	claims, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed id token claims: %w", github.ErrInvalidToken)
+	}
+	return claims, nil
+}
+
+// key returns the signing key kid, refreshing the cached JWKS when it expired or
+// does not know kid.
+func (p *provider) key(kid string) (crypto.PublicKey, error) {
+	d, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key, known := p.keys[kid]
+	stale := time.Since(p.keysFetched) > keysTTL
+	if known && !stale {
+		return key, nil
+	}
+	if time.Since(p.keysFetched) > keysRefreshMin {
+		keys, err := p.fetchKeys(d.JWKSURI)
+		if err != nil && p.keys == nil {
+			return nil, err
+		}
+		if err == nil {
+			p.keys, p.keysFetched = keys, time.Now()
+		}
+		// on error keep verifying with the keys we have
+		key, known = p.keys[kid]
+	}
+	if !known {
+		return nil, fmt.Errorf("id token signed with unknown key %q: %w", kid, github.ErrInvalidToken)
+	}
+	return key, nil
+}
+
+func (p *provider) fetchKeys(jwksURI string) (map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := p.getJSON(jwksURI, &set); err != nil {
+		return nil, fmt.Errorf("failed to fetch oidc signing keys: %w", err)
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		switch k.Kty {
+		case "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(k.N)
+			e, errE := base64.RawURLEncoding.DecodeString(k.E)
+			if errN != nil || errE != nil {
+				continue
+			}
+			keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case "EC":
+			x, errX := base64.RawURLEncoding.DecodeString(k.X)
+			y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+			if k.Crv != "P-256" || errX != nil || errY != nil {
+				continue
+			}
+			keys[k.Kid] = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		}
+	}
+	return keys, nil
+}
@@ -0,0 +1,213 @@
+package oidc
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/harsh082ip/ZapTun/internal/server/github"
+)
+
+// fakeIssuer publishes discovery metadata and a JWKS with its RSA keys and signs
+// ID tokens with them.
+type fakeIssuer struct {
+	*httptest.Server
+	mu        sync.Mutex
+	keys      map[string]*rsa.PrivateKey // published keys by kid
+	jwksCalls atomic.Int32
+}
+
+func newFakeIssuer(t *testing.T) *fakeIssuer {
+	f := &fakeIssuer{keys: make(map[string]*rsa.PrivateKey)}
+	f.addKey(t, "k1")
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 f.URL,
+			"authorization_endpoint": f.URL + "/auth",
+			"token_endpoint":         f.URL + "/token",
+			"jwks_uri":               f.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		f.jwksCalls.Add(1)
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		var keys []map[string]string
+		for kid, k := range f.keys {
+			keys = append(keys, map[string]string{
+				"kid": kid,
+				"kty": "RSA",
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(k.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(k.E)).Bytes()),
+			})
+		}
+		json.NewEncoder(w).Encode(map[string]any{"keys": keys})
+	})
+	f.Server = httptest.NewServer(mux)
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeIssuer) addKey(t *testing.T, kid string) *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.mu.Lock()
+	f.keys[kid] = key
+	f.mu.Unlock()
+	return key
+}
+
+// sign returns a JWT with claims signed by key under kid.
+func sign(t *testing.T, key *rsa.PrivateKey, kid string, claims map[string]any) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": kid})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// token returns an ID token for zaptun signed with k1, with claims overridden by extra.
+func (f *fakeIssuer) token(t *testing.T, extra map[string]any) string {
+	claims := map[string]any{
+		"iss":                f.URL,
+		"aud":                "zaptun",
+		"sub":                "7f3c2a90-51d4-4e0b-9a1e-2b6d8c4f1a03",
+		"exp":                time.Now().Add(5 * time.Minute).Unix(),
+		"name":               "Alice",
+		"preferred_username": "Alice",
+		"groups":             []string{"/Engineering", "ops"},
+	}
+	for k, v := range extra {
+		claims[k] = v
+	}
+	f.mu.Lock()
+	key := f.keys["k1"]
+	f.mu.Unlock()
+	return sign(t, key, "k1", claims)
+}
+
+func newTestProvider(f *fakeIssuer, conf Config) *provider {
+	conf.Issuer, conf.ClientID = f.URL, "zaptun"
+	return New(conf).(*provider)
+}
+
+func TestAuthenticate(t *testing.T) {
+	f := newFakeIssuer(t)
+	p := newTestProvider(f, Config{})
+	user, err := p.Authenticate(f.token(t, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Login != "7f3c2a90-51d4-4e0b-9a1e-2b6d8c4f1a03" || user.Name != "Alice" || !user.Allowed {
+		t.Errorf("user = %+v, want the subject as login", user)
+	}
+	if len(user.Orgs) != 2 || user.Orgs[0] != "engineering" || user.Orgs[1] != "ops" {
+		t.Errorf("orgs = %v, want [engineering ops]", user.Orgs)
+	}
+	// an audience list naming the client is fine too
+	if _, err := p.Authenticate(f.token(t, map[string]any{"aud": []string{"other", "zaptun"}})); err != nil {
+		t.Errorf("audience list: %v", err)
+	}
+}
+
+func TestLoginClaim(t *testing.T) {
+	f := newFakeIssuer(t)
+	p := newTestProvider(f, Config{})
+	// Dex subjects are mixed case, lowercasing could merge two users
+	dex, err := p.Authenticate(f.token(t, map[string]any{"sub": "CgVhbGljZRIFbG9jYWw"}))
+	if err != nil || !github.ValidLogin(dex.Login) {
+		t.Fatalf("Dex subject = %q, %v, want a valid login", dex.Login, err)
+	}
+	other, err := p.Authenticate(f.token(t, map[string]any{"sub": "cgvhbGljZRIFbG9jYWw"}))
+	if err != nil || other.Login == dex.Login {
+		t.Errorf("subject differing in case = %q, %v, want another login than %q", other.Login, err, dex.Login)
+	}
+	again, _ := p.Authenticate(f.token(t, map[string]any{"sub": "CgVhbGljZRIFbG9jYWw"}))
+	if again.Login != dex.Login {
+		t.Errorf("same subject = %q, then %q, want a stable login", dex.Login, again.Login)
+	}
+	// Azure AD subjects are longer than a login may be
+	azure, err := p.Authenticate(f.token(t, map[string]any{"sub": "AAAAAAAAAAAAAAAAAAAAAIkzqFVrSaSaFHy782bbtaQ"}))
+	if err != nil || !github.ValidLogin(azure.Login) {
+		t.Errorf("Azure AD subject = %q, %v, want a valid login", azure.Login, err)
+	}
+
+	// usernames are lowercased, but not hashed
+	if _, err := newTestProvider(f, Config{LoginClaim: "preferred_username"}).Authenticate(f.token(t, map[string]any{"preferred_username": "alice@example.com"})); !errors.Is(err, github.ErrInvalidToken) {
+		t.Errorf("username that is not a valid login: err = %v, want ErrInvalidToken", err)
+	}
+	user, err := newTestProvider(f, Config{LoginClaim: "preferred_username"}).Authenticate(f.token(t, nil))
+	if err != nil || user.Login != "alice" {
+		t.Errorf("preferred_username login = %q, %v, want alice", user.Login, err)
+	}
+}
+
+func TestRejectedTokens(t *testing.T) {
+	f := newFakeIssuer(t)
+	p := newTestProvider(f, Config{})
+	other, _ := rsa.GenerateKey(rand.Reader, 2048)
+	for _, tc := range []struct {
+		name  string
+		token string
+	}{
+		{"expired", f.token(t, map[string]any{"exp": time.Now().Add(-2 * clockSkew).Unix()})},
+		{"not yet valid", f.token(t, map[string]any{"nbf": time.Now().Add(2 * clockSkew).Unix()})},
+		{"wrong audience", f.token(t, map[string]any{"aud": "someone-else"})},
+		{"wrong issuer", f.token(t, map[string]any{"iss": "https://evil.example.com"})},
+		{"unknown kid", sign(t, other, "k9", map[string]any{"iss": f.URL, "aud": "zaptun", "sub": "mallory", "exp": time.Now().Add(time.Minute).Unix()})},
+		{"forged signature", sign(t, other, "k1", map[string]any{"iss": f.URL, "aud": "zaptun", "sub": "mallory", "exp": time.Now().Add(time.Minute).Unix()})},
+		{"missing login", f.token(t, map[string]any{"sub": ""})},
+		{"not a jwt", "gho_abc"},
+	} {
+		if _, err := p.Authenticate(tc.token); !errors.Is(err, github.ErrInvalidToken) {
+			t.Errorf("%s: err = %v, want ErrInvalidToken", tc.name, err)
+		}
+	}
+}
+
+func TestUnknownKidRefetchesKeys(t *testing.T) {
+	f := newFakeIssuer(t)
+	p := newTestProvider(f, Config{})
+	if _, err := p.Authenticate(f.token(t, nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	rotated := f.addKey(t, "k2")
+	token := sign(t, rotated, "k2", map[string]any{"iss": f.URL, "aud": "zaptun", "sub": "bob", "exp": time.Now().Add(time.Minute).Unix()})
+	// right after a fetch an unknown kid does not hit the provider again
+	if _, err := p.Authenticate(token); !errors.Is(err, github.ErrInvalidToken) {
+		t.Errorf("new key within keysRefreshMin: err = %v, want ErrInvalidToken", err)
+	}
+	if n := f.jwksCalls.Load(); n != 1 {
+		t.Errorf("JWKS fetched %d times, want 1", n)
+	}
+
+	p.mu.Lock()
+	p.keysFetched = time.Now().Add(-2 * keysRefreshMin)
+	p.mu.Unlock()
+	if user, err := p.Authenticate(token); err != nil || user.Login != "bob" {
+		t.Errorf("new key after keysRefreshMin = %+v, %v, want bob", user, err)
+	}
+	if n := f.jwksCalls.Load(); n != 2 {
+		t.Errorf("JWKS fetched %d times, want 2", n)
+	}
+}
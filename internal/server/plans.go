@@ -0,0 +1,184 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/harsh082ip/ZapTun/internal/server/github"
+	"github.com/harsh082ip/ZapTun/pkg/db/redis"
+	"github.com/harsh082ip/ZapTun/pkg/tunnel"
+)
+
+const planKeyPrefix = "zaptun:plan:user"
+
+// freePlan applies when the config names no plan for a user.
+var freePlan = tunnel.Plan{
+	Name:             "free",
+	MaxHTTPTunnels:   2,
+	MaxTCPTunnels:    2,
+	MaxReservations:  maxReservations,
+	CustomSubdomains: true,
+}
+
+func planKey(login string) string {
+	return fmt.Sprintf("%s:%s", planKeyPrefix, login)
+}
+
+// planFor resolves the plan of user, see config.ServerConfig.Plans for the order.
+func (s *Server) planFor(user github.User) tunnel.Plan {
+	name := user.Plan
+	if name == "" {
+		var assigned string
+		if err := s.reservations.kv.GetJSONWithMaxRetries(planKey(user.Login), &assigned, storeRetries); err == nil {
+			name = assigned
+		}
+	}
+	if name == "" {
+		name = s.conf.UserPlans[user.Login]
+	}
+	for _, org := range user.Orgs {
+		if name != "" {
+			break
+		}
+		name = s.conf.OrgPlans[org]
+	}
+	if name == "" {
+		name = s.conf.DefaultPlan
+	}
+
+	plan, ok := s.conf.Plans[name]
+	if ok {
+		plan.Name = name
+	} else {
+		if name != "" && name != freePlan.Name {
+			s.logger.LogWarnMessage().Msgf("Plan %q of %s is not configured, using the free plan", name, user.Login)
+		}
+		plan = freePlan
+	}
+	if user.MaxTunnels > 0 {
+		plan.MaxHTTPTunnels = user.MaxTunnels
+		plan.MaxTCPTunnels = user.MaxTunnels
+	}
+	return plan
+}
+
+// tunnelLimit returns the plan's limit for tunnelType and how many such tunnels the
+// user has open. The caller must hold s.mutex.
+func (u *User) tunnelLimit(tunnelType string) (limit, open int) {
+	limit = u.plan.MaxHTTPTunnels
+	if tunnelType == "tcp" {
+		limit = u.plan.MaxTCPTunnels
+	}
+	for _, client := range u.tunnels {
+		if client.tunnelType == tunnelType {
+			open++
+		}
+	}
+	return limit, open
+}
+
+// acquireStream counts a new proxied stream against the plan of client's user. It
+// returns false if the user is at MaxStreams; otherwise the stream must be given
+// back with releaseStream.
+func (s *Server) acquireStream(client *Client) (*User, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	userRec, ok := s.users[client.session.user.Login]
+	if !ok {
+		userRec = s.userRecord(client.session)
+	}
+	if userRec.plan.MaxStreams > 0 && userRec.streams >= userRec.plan.MaxStreams {
+		return nil, false
+	}
+	userRec.streams++
+	return userRec, true
+}
+
+func (s *Server) releaseStream(login string, userRec *User) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	userRec.streams--
+	if userRec.streams == 0 && len(userRec.tunnels) == 0 && s.users[login] == userRec {
+		delete(s.users, login)
+	}
+}
+
+// rateLimiter is a token bucket shared by every stream of one user.
+type rateLimiter struct {
+	mutex  sync.Mutex
+	rate   float64 // bytes per second
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(bytesPerSec int64) *rateLimiter {
+	return &rateLimiter{rate: float64(bytesPerSec), tokens: float64(bytesPerSec), last: time.Now()}
+}
+
+// wait blocks until n bytes may pass. n must not exceed one second worth of bytes.
+func (l *rateLimiter) wait(n int) {
+	l.mutex.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	deficit := -l.tokens
+	l.mutex.Unlock()
+
+	if deficit > 0 {
+		time.Sleep(time.Duration(deficit / l.rate * float64(time.Second)))
+	}
+}
+
+// limitedWriter throttles writes to w with a user's rateLimiter.
+type limitedWriter struct {
+	w       io.Writer
+	limiter *rateLimiter
+}
+
+func (lw *limitedWriter) Write(p []byte) (int, error) {
+	written := 0
+	chunk := int(lw.limiter.rate)
+	if chunk < 1 {
+		chunk = 1
+	}
+	for len(p) > 0 {
+		n := len(p)
+		if n > chunk {
+			n = chunk
+		}
+		lw.limiter.wait(n)
+		m, err := lw.w.Write(p[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// throttle wraps w with the user's bandwidth cap, if the plan has one.
+func (u *User) throttle(w io.Writer) io.Writer {
+	limiter := u.limiter.Load()
+	if limiter == nil {
+		return w
+	}
+	return &limitedWriter{w: w, limiter: limiter}
+}
+
+// AssignPlan stores plan as the plan of login in kv, overriding the config. An
+// empty plan removes the assignment.
+func AssignPlan(kv redis.RedisStoreWithRetries, login, plan string) error {
+	login = strings.ToLower(login)
+	if plan == "" {
+		return kv.DelWithMaxRetries(planKey(login), storeRetries)
+	}
+	return kv.SetJSONWithMaxRetries(planKey(login), plan, 0, storeRetries)
+}
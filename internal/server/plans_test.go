@@ -0,0 +1,31 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/harsh082ip/ZapTun/config"
+	"github.com/harsh082ip/ZapTun/internal/server/github"
+	"github.com/harsh082ip/ZapTun/pkg/tunnel"
+)
+
+func TestPlanFor(t *testing.T) {
+	s := newTestServer(&config.ServerConfig{
+		Plans:     map[string]tunnel.Plan{"pro": {MaxHTTPTunnels: 10, MaxTCPTunnels: 5}},
+		UserPlans: map[string]string{"alice": "pro", "bob": "enterprise"},
+	})
+	for _, tc := range []struct {
+		login    string
+		wantName string
+		wantHTTP int
+	}{
+		{"alice", "pro", 10},
+		// a plan missing from the config falls back to the free plan, name included
+		{"bob", freePlan.Name, freePlan.MaxHTTPTunnels},
+		{"carol", freePlan.Name, freePlan.MaxHTTPTunnels},
+	} {
+		plan := s.planFor(github.User{Login: tc.login})
+		if plan.Name != tc.wantName || plan.MaxHTTPTunnels != tc.wantHTTP {
+			t.Errorf("%s: plan = %q with %d HTTP tunnels, want %q with %d", tc.login, plan.Name, plan.MaxHTTPTunnels, tc.wantName, tc.wantHTTP)
+		}
+	}
+}
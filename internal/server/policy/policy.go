@@ -0,0 +1,109 @@
+// Package policy decides which authenticated users may open tunnels, based on
+// allow and deny lists and the age of their account.
+package policy
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/harsh082ip/ZapTun/config"
+	"github.com/harsh082ip/ZapTun/internal/server/filewatch"
+	"github.com/harsh082ip/ZapTun/internal/server/github"
+	log "github.com/harsh082ip/ZapTun/pkg/logger"
+	"github.com/harsh082ip/ZapTun/pkg/tunnel"
+)
+
+// Decision is the outcome of evaluating the policy for a user. Reason is one of
+// the tunnel.Deny* constants when the user is denied.
+type Decision struct {
+	Allowed bool
+	Reason  string
+	Message string
+}
+
+// Engine holds the current policy. It is safe for concurrent use.
+type Engine struct {
+	mutex  sync.RWMutex
+	rules  config.PolicyConfig
+	logger *log.Logger
+}
+
+func New(rules config.PolicyConfig, logger *log.Logger) *Engine {
+	return &Engine{rules: rules, logger: logger}
+}
+
+// Set replaces the policy.
+func (e *Engine) Set(rules config.PolicyConfig) {
+	e.mutex.Lock()
+	e.rules = rules
+	e.mutex.Unlock()
+}
+
+// Evaluate applies the policy to user.
+func (e *Engine) Evaluate(user github.User) Decision {
+	e.mutex.RLock()
+	rules := e.rules
+	e.mutex.RUnlock()
+
+	login := strings.ToLower(user.Login)
+	if contains(rules.DenyLogins, login) {
+		return deny(tunnel.DenyListed, "user %s is not allowed to open tunnels on this server", user.Login)
+	}
+
+	restricted := len(rules.AllowLogins) > 0 || len(rules.AllowOrgs) > 0 || len(rules.AllowTeams) > 0
+	if restricted && !contains(rules.AllowLogins, login) && !containsAny(rules.AllowOrgs, user.Orgs) && !containsAny(rules.AllowTeams, user.Teams) {
+		return deny(tunnel.DenyNotAllowed, "user %s is not a member of an organization or team allowed on this server", user.Login)
+	}
+
+	if rules.MinAccountAgeDays > 0 && user.JoinedDate != "" {
+		joined, err := time.Parse(time.RFC3339, user.JoinedDate)
+		minAge := time.Duration(rules.MinAccountAgeDays) * 24 * time.Hour
+		if err == nil && time.Since(joined) < minAge {
+			return deny(tunnel.DenyAccountTooNew, "accounts must be at least %d days old to open tunnels, %s was created on %s",
+				rules.MinAccountAgeDays, user.Login, joined.Format("2006-01-02"))
+		}
+	}
+	return Decision{Allowed: true}
+}
+
+func deny(reason, format string, args ...interface{}) Decision {
+	return Decision{Reason: reason, Message: fmt.Sprintf(format, args...)}
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsAny(list, values []string) bool {
+	for _, value := range values {
+		if contains(list, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// Watch has w reload the policy from the server config at path on SIGHUP and
+// whenever the file changes. onChange is called after every successful reload. A
+// broken file keeps the previous policy.
+func (e *Engine) Watch(w *filewatch.Watcher, path string, onChange func()) {
+	w.Add(func() {
+		cfg, err := config.LoadServerConfig(path)
+		if err != nil {
+			e.logger.LogErrorMessage().Err(err).Msgf("Failed to reload policy from %s, keeping the current one", path)
+			return
+		}
+		e.Set(cfg.Policy)
+		e.logger.LogInfoMessage().Msgf("Reloaded policy from %s", path)
+		if onChange != nil {
+			onChange()
+		}
+	}, path)
+}
@@ -0,0 +1,241 @@
+package server
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/harsh082ip/ZapTun/pkg/db/redis"
+	"github.com/harsh082ip/ZapTun/pkg/tunnel"
+)
+
+const (
+	reservationKeyPrefix   = "zaptun:reservation"
+	reservationIndexPrefix = "zaptun:reservations"
+	reservationLockPrefix  = "zaptun:lock:reservation"
+	reservationLockTTL     = 10 * time.Second
+	storeRetries           = 2
+
+	// maxReservations is the number of subdomains and ports a user of the free plan may hold.
+	maxReservations = 5
+)
+
+// errReservationBusy is returned when another server or session holds the lock
+// for the same name; the client can simply retry.
+var errReservationBusy = fmt.Errorf("reservation is being modified, try again")
+
+// reservationStore keeps reserved subdomains and TCP ports in the KV store so
+// they survive server restarts. Every reservation is stored under its own key,
+// plus a per-user index listing the keys the user owns.
+type reservationStore struct {
+	kv redis.RedisStoreWithRetries
+}
+
+func reservationKey(kind, name string) string {
+	return fmt.Sprintf("%s:%s:%s", reservationKeyPrefix, kind, name)
+}
+
+func reservationIndexKey(owner string) string {
+	return fmt.Sprintf("%s:%s", reservationIndexPrefix, owner)
+}
+
+// keyOf returns the name a reservation is stored under.
+func keyOf(r *tunnel.Reservation) string {
+	if r.Kind == tunnel.ReservationTCPPort {
+		return fmt.Sprint(r.Port)
+	}
+	return r.Name
+}
+
+// lookup returns the reservation for kind/name, or nil if nobody holds it.
+func (rs *reservationStore) lookup(kind, name string) (*tunnel.Reservation, error) {
+	var r tunnel.Reservation
+	if found, err := redis.GetJSONIfExists(rs.kv, reservationKey(kind, name), &r); err != nil || !found {
+		return nil, err
+	}
+	return &r, nil
+}
+
+func reservationLockKey(kind, name string) string {
+	return fmt.Sprintf("%s:%s:%s", reservationLockPrefix, kind, name)
+}
+
+// lock takes the per-name lock, so two servers cannot hand out the same name.
+func (rs *reservationStore) lock(kind, name, owner string) error {
+	acquired, err := rs.kv.AcquireLockWithMaxRetries(reservationLockKey(kind, name), owner, reservationLockTTL, storeRetries)
+	if err != nil {
+		return err
+	}
+	if !acquired {
+		return errReservationBusy
+	}
+	return nil
+}
+
+func (rs *reservationStore) unlock(kind, name string) {
+	rs.kv.ReleaseLockWithMaxRetries(reservationLockKey(kind, name), storeRetries)
+}
+
+func (rs *reservationStore) index(owner string) ([]string, error) {
+	var keys []string
+	if _, err := redis.GetJSONIfExists(rs.kv, reservationIndexKey(owner), &keys); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// list returns every reservation held by owner.
+func (rs *reservationStore) list(owner string) ([]tunnel.Reservation, error) {
+	keys, err := rs.index(owner)
+	if err != nil {
+		return nil, err
+	}
+	var reservations []tunnel.Reservation
+	for _, key := range keys {
+		var r tunnel.Reservation
+		if err := rs.kv.GetJSON(key, &r); err != nil {
+			continue // released concurrently
+		}
+		reservations = append(reservations, r)
+	}
+	return reservations, nil
+}
+
+// reserve records r for r.Owner. It fails with *tunnel.Error when the name is held
+// by someone else or the owner already holds limit reservations (0 is unlimited).
+func (rs *reservationStore) reserve(r *tunnel.Reservation, limit int) error {
+	name := keyOf(r)
+	if err := rs.lock(r.Kind, name, r.Owner); err != nil {
+		return err
+	}
+	defer rs.unlock(r.Kind, name)
+	if err := rs.lock("owner", r.Owner, r.Owner); err != nil {
+		return err
+	}
+	defer rs.unlock("owner", r.Owner)
+
+	existing, err := rs.lookup(r.Kind, name)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		if existing.Owner == r.Owner {
+			*r = *existing
+			return nil
+		}
+		return &tunnel.Error{Code: tunnel.ErrSubdomainTaken, Message: fmt.Sprintf("%s %s is reserved by another user", r.Kind, name)}
+	}
+
+	keys, err := rs.index(r.Owner)
+	if err != nil {
+		return err
+	}
+	if limit > 0 && len(keys) >= limit {
+		return &tunnel.Error{Code: tunnel.ErrReservationLimit, Message: fmt.Sprintf("reservation limit reached (%d)", limit)}
+	}
+
+	r.CreatedAt = time.Now().UTC()
+	key := reservationKey(r.Kind, name)
+	if err := rs.kv.SetJSONWithMaxRetries(key, r, 0, storeRetries); err != nil {
+		return err
+	}
+	return rs.kv.SetJSONWithMaxRetries(reservationIndexKey(r.Owner), append(keys, key), 0, storeRetries)
+}
+
+// release removes the reservation kind/name if it belongs to owner.
+func (rs *reservationStore) release(owner, kind, name string) (*tunnel.Reservation, error) {
+	if err := rs.lock(kind, name, owner); err != nil {
+		return nil, err
+	}
+	defer rs.unlock(kind, name)
+	if err := rs.lock("owner", owner, owner); err != nil {
+		return nil, err
+	}
+	defer rs.unlock("owner", owner)
+
+	existing, err := rs.lookup(kind, name)
+	if err != nil {
+		return nil, err
+	}
+	if existing == nil || existing.Owner != owner {
+		return nil, &tunnel.Error{Code: tunnel.ErrNotFound, Message: fmt.Sprintf("you have no reservation for %s %s", kind, name)}
+	}
+
+	key := reservationKey(kind, name)
+	if err := rs.kv.DelWithMaxRetries(key, storeRetries); err != nil {
+		return nil, err
+	}
+	keys, err := rs.index(owner)
+	if err != nil {
+		return nil, err
+	}
+	remaining := keys[:0]
+	for _, k := range keys {
+		if k != key {
+			remaining = append(remaining, k)
+		}
+	}
+	return existing, rs.kv.SetJSONWithMaxRetries(reservationIndexKey(owner), remaining, 0, storeRetries)
+}
+
+// reservedByOther reports whether kind/name is reserved by anyone but login.
+func (rs *reservationStore) reservedByOther(kind, name, login string) (bool, error) {
+	r, err := rs.lookup(kind, name)
+	if err != nil || r == nil {
+		return false, err
+	}
+	return r.Owner != login, nil
+}
+
+// handleReservation serves the reserve, release and list commands of a session.
+func (s *Server) handleReservation(sess *Session, msg *tunnel.Message) {
+	login := sess.user.Login
+	var reservations []tunnel.Reservation
+	var err error
+
+	switch msg.Type {
+	case tunnel.MsgListReservations:
+		reservations, err = s.reservations.list(login)
+
+	case tunnel.MsgReserve:
+		r := &tunnel.Reservation{Kind: msg.Reservation.Kind, Owner: login}
+		switch r.Kind {
+		case tunnel.ReservationSubdomain:
+			if !sess.plan.CustomSubdomains {
+				err = &tunnel.Error{Code: tunnel.ErrPlanRestricted, Message: fmt.Sprintf("custom subdomains are not included in the %s plan", sess.plan.Name)}
+				break
+			}
+			r.Name, err = requestedSubdomain(msg.Reservation.Name, login)
+			if err != nil {
+				err = &tunnel.Error{Code: tunnel.ErrSubdomainNotAllowed, Message: err.Error()}
+			}
+		case tunnel.ReservationTCPPort:
+			r.Port, err = s.allocateTCPPort()
+		default:
+			err = &tunnel.Error{Code: tunnel.ErrBadRequest, Message: fmt.Sprintf("unknown reservation kind %q", r.Kind)}
+		}
+		if err == nil {
+			err = s.reservations.reserve(r, sess.plan.MaxReservations)
+		}
+		reservations = []tunnel.Reservation{*r}
+
+	case tunnel.MsgRelease:
+		var released *tunnel.Reservation
+		name := keyOf(msg.Reservation)
+		if msg.Reservation.Kind == tunnel.ReservationSubdomain {
+			name, _ = requestedSubdomain(msg.Reservation.Name, login)
+		}
+		released, err = s.reservations.release(login, msg.Reservation.Kind, name)
+		if released != nil {
+			reservations = []tunnel.Reservation{*released}
+		}
+	}
+
+	if err != nil {
+		s.replyError(sess, fmt.Sprintf("Reservation command %s", msg.Type), err)
+		return
+	}
+	if msg.Type != tunnel.MsgListReservations {
+		s.logger.LogInfoMessage().Msgf("%s %s %s for %s", msg.Type, reservations[0].Kind, keyOf(&reservations[0]), login)
+	}
+	sess.ctrl.Send(&tunnel.Message{Type: tunnel.MsgReservations, Reservations: reservations})
+}
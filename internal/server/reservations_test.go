@@ -0,0 +1,196 @@
+package server
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/harsh082ip/ZapTun/config"
+	"github.com/harsh082ip/ZapTun/pkg/db/redis"
+	"github.com/harsh082ip/ZapTun/pkg/tunnel"
+)
+
+func newTestReservations() *reservationStore {
+	return &reservationStore{kv: redis.NewMemoryStore()}
+}
+
+func errorCode(err error) tunnel.ErrorCode {
+	var serverErr *tunnel.Error
+	if errors.As(err, &serverErr) {
+		return serverErr.Code
+	}
+	return ""
+}
+
+func TestReserveAndList(t *testing.T) {
+	rs := newTestReservations()
+	sub := &tunnel.Reservation{Kind: tunnel.ReservationSubdomain, Name: "api-alice", Owner: "alice"}
+	port := &tunnel.Reservation{Kind: tunnel.ReservationTCPPort, Port: 20001, Owner: "alice"}
+	for _, r := range []*tunnel.Reservation{sub, port} {
+		if err := rs.reserve(r, 0); err != nil {
+			t.Fatalf("reserve %s: %v", keyOf(r), err)
+		}
+		if r.CreatedAt.IsZero() {
+			t.Errorf("reserve %s did not set CreatedAt", keyOf(r))
+		}
+	}
+
+	list, err := rs.list("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].Name != "api-alice" || list[1].Port != 20001 {
+		t.Errorf("list = %+v, want api-alice and port 20001", list)
+	}
+	if list, _ := rs.list("bob"); len(list) != 0 {
+		t.Errorf("list for bob = %+v, want none", list)
+	}
+}
+
+func TestReserveTwiceBySameOwner(t *testing.T) {
+	rs := newTestReservations()
+	first := &tunnel.Reservation{Kind: tunnel.ReservationSubdomain, Name: "api-alice", Owner: "alice"}
+	if err := rs.reserve(first, 1); err != nil {
+		t.Fatal(err)
+	}
+	// holding the limit already must not matter for a name the owner holds
+	again := &tunnel.Reservation{Kind: tunnel.ReservationSubdomain, Name: "api-alice", Owner: "alice"}
+	if err := rs.reserve(again, 1); err != nil {
+		t.Fatalf("reserving an owned name again: %v", err)
+	}
+	if !again.CreatedAt.Equal(first.CreatedAt) {
+		t.Errorf("CreatedAt = %v, want the original %v", again.CreatedAt, first.CreatedAt)
+	}
+	if list, _ := rs.list("alice"); len(list) != 1 {
+		t.Errorf("list = %+v, want a single reservation", list)
+	}
+}
+
+func TestReserveTakenByOther(t *testing.T) {
+	rs := newTestReservations()
+	if err := rs.reserve(&tunnel.Reservation{Kind: tunnel.ReservationTCPPort, Port: 20001, Owner: "alice"}, 0); err != nil {
+		t.Fatal(err)
+	}
+	err := rs.reserve(&tunnel.Reservation{Kind: tunnel.ReservationTCPPort, Port: 20001, Owner: "bob"}, 0)
+	if code := errorCode(err); code != tunnel.ErrSubdomainTaken {
+		t.Errorf("reserve by bob: err = %v, want %s", err, tunnel.ErrSubdomainTaken)
+	}
+
+	for _, tc := range []struct {
+		login string
+		want  bool
+	}{{"alice", false}, {"bob", true}} {
+		got, err := rs.reservedByOther(tunnel.ReservationTCPPort, "20001", tc.login)
+		if err != nil || got != tc.want {
+			t.Errorf("reservedByOther(%s) = %v, %v, want %v", tc.login, got, err, tc.want)
+		}
+	}
+	if got, err := rs.reservedByOther(tunnel.ReservationTCPPort, "20002", "bob"); err != nil || got {
+		t.Errorf("reservedByOther for a free port = %v, %v, want false", got, err)
+	}
+}
+
+func TestReserveLimit(t *testing.T) {
+	rs := newTestReservations()
+	for _, name := range []string{"a-alice", "b-alice"} {
+		if err := rs.reserve(&tunnel.Reservation{Kind: tunnel.ReservationSubdomain, Name: name, Owner: "alice"}, 2); err != nil {
+			t.Fatalf("reserve %s: %v", name, err)
+		}
+	}
+	err := rs.reserve(&tunnel.Reservation{Kind: tunnel.ReservationSubdomain, Name: "c-alice", Owner: "alice"}, 2)
+	if code := errorCode(err); code != tunnel.ErrReservationLimit {
+		t.Errorf("third reservation: err = %v, want %s", err, tunnel.ErrReservationLimit)
+	}
+	if r, err := rs.lookup(tunnel.ReservationSubdomain, "c-alice"); err != nil || r != nil {
+		t.Errorf("lookup c-alice = %+v, %v, want no reservation", r, err)
+	}
+}
+
+func TestRelease(t *testing.T) {
+	rs := newTestReservations()
+	for _, name := range []string{"a-alice", "b-alice"} {
+		if err := rs.reserve(&tunnel.Reservation{Kind: tunnel.ReservationSubdomain, Name: name, Owner: "alice"}, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := rs.release("bob", tunnel.ReservationSubdomain, "a-alice"); errorCode(err) != tunnel.ErrNotFound {
+		t.Errorf("release by bob: err = %v, want %s", err, tunnel.ErrNotFound)
+	}
+	released, err := rs.release("alice", tunnel.ReservationSubdomain, "a-alice")
+	if err != nil || released == nil || released.Name != "a-alice" {
+		t.Fatalf("release = %+v, %v", released, err)
+	}
+	if _, err := rs.release("alice", tunnel.ReservationSubdomain, "a-alice"); errorCode(err) != tunnel.ErrNotFound {
+		t.Errorf("second release: err = %v, want %s", err, tunnel.ErrNotFound)
+	}
+
+	list, _ := rs.list("alice")
+	if len(list) != 1 || list[0].Name != "b-alice" {
+		t.Errorf("list after release = %+v, want only b-alice", list)
+	}
+	// a released name is free for anyone
+	if err := rs.reserve(&tunnel.Reservation{Kind: tunnel.ReservationSubdomain, Name: "a-alice", Owner: "bob"}, 0); err != nil {
+		t.Errorf("reserve released name: %v", err)
+	}
+}
+
+func TestReservedByOtherStoreError(t *testing.T) {
+	rs := &reservationStore{kv: failingStore{redis.NewMemoryStore()}}
+	if _, err := rs.reservedByOther(tunnel.ReservationSubdomain, "alice", "bob"); err == nil {
+		t.Error("reservedByOther hid the store error")
+	}
+}
+
+// failingStore is a KV store whose reads fail, like an unreachable Redis.
+type failingStore struct {
+	redis.RedisStoreWithRetries
+}
+
+func (failingStore) Exists(string) (bool, error) {
+	return false, errors.New("connection refused")
+}
+
+// blockingStore is a KV store whose reads hang until release is closed, like a
+// Redis that stopped answering.
+type blockingStore struct {
+	redis.RedisStoreWithRetries
+	release chan struct{}
+}
+
+func (b blockingStore) Exists(key string) (bool, error) {
+	<-b.release
+	return b.RedisStoreWithRetries.Exists(key)
+}
+
+func TestSlowReservationLookupKeepsMutexFree(t *testing.T) {
+	store := blockingStore{redis.NewMemoryStore(), make(chan struct{})}
+	s := newTestServer(&config.ServerConfig{})
+	s.reservations = &reservationStore{kv: store}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.allocMutex.Lock()
+		defer s.allocMutex.Unlock()
+		s.freeTunnelID("alice")
+		s.allocateTCPPort()
+	}()
+
+	// the data plane must still get the registry while the store hangs
+	for i := 0; i < 2; i++ {
+		locked := make(chan struct{})
+		go func() {
+			s.mutex.Lock()
+			s.mutex.Unlock()
+			close(locked)
+		}()
+		select {
+		case <-locked:
+		case <-time.After(time.Second):
+			t.Fatal("s.mutex held during a reservation lookup")
+		}
+		store.release <- struct{}{}
+	}
+	<-done
+}
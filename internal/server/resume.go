@@ -0,0 +1,110 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+)
+
+const defaultResumeGrace = 60 * time.Second
+
+// heldTunnel keeps the public address of a tunnel whose session went away, so a
+// reconnecting client that presents the resume token gets the same address back.
+type heldTunnel struct {
+	token      string
+	login      string
+	tunnelType string
+	id         string
+	port       int // tcp only
+	expiresAt  time.Time
+}
+
+func newResumeToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func (s *Server) resumeGrace() time.Duration {
+	if s.conf.ResumeGraceSeconds > 0 {
+		return time.Duration(s.conf.ResumeGraceSeconds) * time.Second
+	}
+	return defaultResumeGrace
+}
+
+// holdTunnel keeps the ID and port of client for the resume grace period.
+// The caller must hold s.mutex.
+func (s *Server) holdTunnel(client *Client) {
+	if client.resumeToken == "" {
+		return
+	}
+	// drop holds nobody came back for, so the maps do not grow forever
+	for _, h := range s.held {
+		s.live(h)
+	}
+	h := &heldTunnel{
+		token:      client.resumeToken,
+		login:      client.session.user.Login,
+		tunnelType: client.tunnelType,
+		id:         client.id,
+		port:       client.port,
+		expiresAt:  time.Now().Add(s.resumeGrace()),
+	}
+	s.held[h.token] = h
+	s.heldIDs[h.id] = h
+	if h.port != 0 {
+		s.heldPorts[h.port] = h
+	}
+}
+
+// releaseHeld gives the address of h free again. The caller must hold s.mutex.
+func (s *Server) releaseHeld(h *heldTunnel) {
+	delete(s.held, h.token)
+	delete(s.heldIDs, h.id)
+	if h.port != 0 {
+		delete(s.heldPorts, h.port)
+	}
+}
+
+// live returns h, or nil after releasing it if its grace period is over.
+// The caller must hold s.mutex.
+func (s *Server) live(h *heldTunnel) *heldTunnel {
+	if h == nil {
+		return nil
+	}
+	if time.Now().After(h.expiresAt) {
+		s.releaseHeld(h)
+		return nil
+	}
+	return h
+}
+
+// heldID returns the hold on a tunnel ID, if any. The caller must hold s.mutex.
+func (s *Server) heldID(id string) *heldTunnel {
+	return s.live(s.heldIDs[id])
+}
+
+// heldPort returns the hold on a public TCP port, if any. The caller must hold s.mutex.
+func (s *Server) heldPort(port int) *heldTunnel {
+	return s.live(s.heldPorts[port])
+}
+
+// resumedTunnel returns the address held for token if it belongs to login and
+// has the same tunnel type; the caller releases it once the tunnel is registered
+// again. If the old session is still registered, e.g. because the server has not
+// noticed yet that its connection is dead, its tunnel is evicted first.
+// The caller must hold s.mutex.
+func (s *Server) resumedTunnel(token, login, tunnelType string) *heldTunnel {
+	if token == "" {
+		return nil
+	}
+	if client, ok := s.resumable[token]; ok && client.session.user.Login == login {
+		s.logger.LogInfoMessage().Msgf("Tunnel %s resumed by a new session, evicting the old one", client.id)
+		s.removeTunnel(client, true)
+	}
+	h := s.live(s.held[token])
+	if h == nil || h.login != login || h.tunnelType != tunnelType {
+		return nil
+	}
+	return h
+}
@@ -1,46 +1,170 @@
 package server
 
 import (
+	"context"
 	"net"
+	"net/http"
+	"os/signal"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/harsh082ip/ZapTun/config"
+	"github.com/harsh082ip/ZapTun/internal/mux"
+	"github.com/harsh082ip/ZapTun/internal/server/certauth"
+	"github.com/harsh082ip/ZapTun/internal/server/credential"
+	"github.com/harsh082ip/ZapTun/internal/server/filewatch"
 	"github.com/harsh082ip/ZapTun/internal/server/github"
+	"github.com/harsh082ip/ZapTun/internal/server/policy"
+	"github.com/harsh082ip/ZapTun/pkg/db/redis"
 	log "github.com/harsh082ip/ZapTun/pkg/logger"
-	"github.com/hashicorp/yamux"
+	"github.com/harsh082ip/ZapTun/pkg/tunnel"
 )
 
+const (
+	defaultHeartbeatInterval = 15 * time.Second
+	defaultHeartbeatTimeout  = 45 * time.Second
+)
+
+// Client is a single tunnel registered by a session.
 type Client struct {
-	id       string // unique subdomain
-	session  *yamux.Session
-	listener net.Listener
+	id         string // unique subdomain for http, tcp-<login>-<port> for tcp
+	tunnelType string
+	session    *Session
+	listener   net.Listener
+	port       int // public port for tcp tunnels
+
+	resumeToken string
 }
 
+// Session is one authenticated control connection. It can carry several tunnels,
+// all multiplexed over the same stream multiplexer session.
+type Session struct {
+	user     github.User
+	plan     tunnel.Plan
+	tokenID  string   // machine token the session authenticated with, if any
+	features []string // negotiated protocol features
+	mux      mux.Session
+	ctrl     *tunnel.ControlConn
+	tunnels  map[string]*Client // guarded by Server.mutex
+
+	heartbeat *tunnel.Heartbeat // nil if the client does not support heartbeats
+}
+
+// User tracks the tunnels and usage of one login across all of its sessions.
 type User struct {
-	tunnels   map[string]*Client
-	maxTunnel int
+	tunnels map[string]*Client
+	plan    tunnel.Plan
+	streams int // proxied streams in flight
+	// limiter is nil without a bandwidth cap. It is replaced under the server's
+	// mutex but read by streams in flight without it.
+	limiter atomic.Pointer[rateLimiter]
 }
 
 type Server struct {
 	conf          *config.ServerConfig
 	logger        *log.Logger
 	users         map[string]*User
+	httpTunnels   map[string]*Client // subdomain -> tunnel, used by the data plane
+	resumable     map[string]*Client // resume token -> live tunnel
+	held          map[string]*heldTunnel
+	heldIDs       map[string]*heldTunnel
+	heldPorts     map[int]*heldTunnel
 	mutex         sync.RWMutex
+	allocMutex    sync.Mutex // serializes tunnel allocation, see handleHTTPTunnel and handleTCPTunnel
 	nextTCPPort   int
 	authenticator github.Authenticator
+	credentials   *credential.Issuer      // nil when session credentials are disabled
+	certAuth      *certauth.Authenticator // nil without client_ca_path
+	policy        *policy.Engine
+	reservations  *reservationStore
+	tokens        *tokenStore
+	guard         *authGuard
+	certs         *certStore
+
+	// shutdown state, guarded by mutex
+	sessions        map[*Session]struct{}
+	controlListener net.Listener
+	dataServer      *http.Server
+	draining        bool
+	streams         sync.WaitGroup // in-flight public TCP connections
 }
 
-func NewServer(conf *config.ServerConfig, logger *log.Logger, oauth github.Authenticator) *Server {
+func NewServer(conf *config.ServerConfig, logger *log.Logger, oauth github.Authenticator, store redis.RedisStoreWithRetries) *Server {
 	return &Server{
 		conf:          conf,
 		logger:        logger,
 		users:         make(map[string]*User),
+		httpTunnels:   make(map[string]*Client),
+		resumable:     make(map[string]*Client),
+		held:          make(map[string]*heldTunnel),
+		heldIDs:       make(map[string]*heldTunnel),
+		heldPorts:     make(map[int]*heldTunnel),
+		sessions:      make(map[*Session]struct{}),
 		nextTCPPort:   30000, // will change port allocation logic in future PRs
 		authenticator: oauth,
+		policy:        policy.New(conf.Policy, logger),
+		reservations:  &reservationStore{kv: store},
+		tokens:        &tokenStore{kv: store},
+		guard:         newAuthGuard(conf, store),
 	}
 }
 
+// heartbeatSettings returns the configured ping interval and dead-session timeout.
+func (s *Server) heartbeatSettings() (interval, timeout time.Duration) {
+	interval, timeout = defaultHeartbeatInterval, defaultHeartbeatTimeout
+	if s.conf.HeartbeatIntervalSeconds > 0 {
+		interval = time.Duration(s.conf.HeartbeatIntervalSeconds) * time.Second
+	}
+	if s.conf.HeartbeatTimeoutSeconds > 0 {
+		timeout = time.Duration(s.conf.HeartbeatTimeoutSeconds) * time.Second
+	}
+	return interval, timeout
+}
+
+// Start runs the control and data planes until SIGINT or SIGTERM, then drains
+// the server gracefully (see Shutdown).
 func (s *Server) Start() error {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if s.credentialsEnabled() {
+		key, err := credential.LoadKey(s.reservations.kv, s.conf.CredentialSecret)
+		if err != nil {
+			return err
+		}
+		ttl := time.Duration(s.conf.CredentialTTLHours) * time.Hour
+		maxLifetime := time.Duration(s.conf.CredentialMaxLifetimeHours) * time.Hour
+		s.credentials = credential.NewIssuer(key, s.conf.Domain, ttl, maxLifetime)
+		go s.watchRevokedTokens(ctx)
+	}
+
+	certs, err := loadCertStore(s.conf, s.logger)
+	if err != nil {
+		return err
+	}
+	s.certs = certs
+	// one watcher handles SIGHUP and file changes for everything reloadable
+	watcher := filewatch.New()
+	certs.Watch(watcher)
+	go certs.WarnExpiryDaily(ctx)
+
+	if ca, ok := s.authenticator.(*certauth.Authenticator); ok {
+		s.certAuth = ca
+	} else if s.conf.ClientCAPath != "" {
+		ca, err := certauth.Load(s.conf.ClientCAPath)
+		if err != nil {
+			return err
+		}
+		s.certAuth = ca
+	}
+
+	if s.conf.Path() != "" {
+		s.policy.Watch(watcher, s.conf.Path(), s.enforcePolicy)
+	}
+	go watcher.Run(ctx)
+
 	var wg sync.WaitGroup
 	wg.Add(2)
 
@@ -54,7 +178,51 @@ func (s *Server) Start() error {
 		s.startDataPlane()
 	}()
 
+	planesDone := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(planesDone)
+	}()
+
 	s.logger.LogInfoMessage().Msg("Server started succesfully. Waiting for connections...")
-	wg.Wait()
-	return nil
+	select {
+	case <-planesDone:
+		return nil
+	case <-ctx.Done():
+	}
+	stop() // a second signal kills the process right away
+
+	timeout, _ := s.shutdownSettings()
+	s.logger.LogInfoMessage().Msgf("Shutdown signal received, draining for up to %s", timeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return s.Shutdown(shutdownCtx)
+}
+
+func accessDenied(decision policy.Decision) *tunnel.Message {
+	return &tunnel.Message{
+		Type:  tunnel.MsgError,
+		Error: &tunnel.Error{Code: tunnel.ErrAccessDenied, Reason: decision.Reason, Message: decision.Message},
+	}
+}
+
+// enforcePolicy re-evaluates every live session after the policy changed and
+// disconnects users who are no longer allowed.
+func (s *Server) enforcePolicy() {
+	s.mutex.RLock()
+	var denied []*Session
+	var decisions []policy.Decision
+	for sess := range s.sessions {
+		if decision := s.policy.Evaluate(sess.user); !decision.Allowed {
+			denied = append(denied, sess)
+			decisions = append(decisions, decision)
+		}
+	}
+	s.mutex.RUnlock()
+
+	for i, sess := range denied {
+		s.logger.LogWarnMessage().Msgf("Policy now denies %s (%s), closing session", sess.user.Login, decisions[i].Reason)
+		sess.ctrl.Send(accessDenied(decisions[i]))
+		sess.mux.Close()
+	}
 }
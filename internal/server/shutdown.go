@@ -0,0 +1,115 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/harsh082ip/ZapTun/pkg/tunnel"
+)
+
+const (
+	defaultShutdownTimeout = 30 * time.Second
+	defaultReconnectHint   = 5 * time.Second
+)
+
+// shutdownSettings returns how long in-flight traffic may drain and when
+// clients should come back.
+func (s *Server) shutdownSettings() (timeout, reconnectHint time.Duration) {
+	timeout, reconnectHint = defaultShutdownTimeout, defaultReconnectHint
+	if s.conf.ShutdownTimeoutSeconds > 0 {
+		timeout = time.Duration(s.conf.ShutdownTimeoutSeconds) * time.Second
+	}
+	if s.conf.ReconnectHintSeconds > 0 {
+		reconnectHint = time.Duration(s.conf.ReconnectHintSeconds) * time.Second
+	}
+	return timeout, reconnectHint
+}
+
+// goAway tells a client that the server is shutting down and when to reconnect.
+func (s *Server) goAway(ctrl *tunnel.ControlConn) error {
+	_, reconnectHint := s.shutdownSettings()
+	return ctrl.Send(&tunnel.Message{
+		Type: tunnel.MsgGoAway,
+		GoAway: &tunnel.GoAway{
+			Reason:           "server is restarting",
+			ReconnectAfterMs: reconnectHint.Milliseconds(),
+		},
+	})
+}
+
+// refuseDraining turns down a session or tunnel request that arrives while the
+// server drains. The go-away notice first tells the client when to come back.
+func (s *Server) refuseDraining(ctrl *tunnel.ControlConn) {
+	s.goAway(ctrl)
+	ctrl.Send(tunnel.NewError(tunnel.ErrGoingAway, "server is shutting down, try again shortly"))
+}
+
+// beginStreams counts n in-flight streams for the drain, each to be ended with
+// s.streams.Done. It returns false once Shutdown started waiting for streams,
+// which then must not be opened.
+func (s *Server) beginStreams(n int) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.draining {
+		return false
+	}
+	s.streams.Add(n)
+	return true
+}
+
+// Shutdown drains the server: it stops accepting control connections, tells every
+// client that the server is going away, lets in-flight HTTP requests and TCP streams
+// finish until ctx expires, and then closes all sessions.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mutex.Lock()
+	s.draining = true
+	if s.controlListener != nil {
+		s.controlListener.Close()
+	}
+	sessions := make([]*Session, 0, len(s.sessions))
+	for sess := range s.sessions {
+		sessions = append(sessions, sess)
+	}
+	// no new public TCP connections; accepted ones keep running until they finish
+	for _, user := range s.users {
+		for _, client := range user.tunnels {
+			if client.listener != nil {
+				client.listener.Close()
+			}
+		}
+	}
+	dataServer := s.dataServer
+	s.mutex.Unlock()
+
+	s.logger.LogInfoMessage().Msgf("Draining %d session(s)", len(sessions))
+	for _, sess := range sessions {
+		s.goAway(sess.ctrl)
+	}
+
+	var err error
+	if dataServer != nil {
+		// waits for in-flight HTTP requests, new ones are refused
+		if err = dataServer.Shutdown(ctx); err != nil {
+			s.logger.LogWarnMessage().Err(err).Msg("Data plane did not drain in time")
+		}
+	}
+
+	streamsDone := make(chan struct{})
+	go func() {
+		s.streams.Wait()
+		close(streamsDone)
+	}()
+	select {
+	case <-streamsDone:
+	case <-ctx.Done():
+		s.logger.LogWarnMessage().Msg("TCP streams did not drain in time, closing them")
+		err = ctx.Err()
+	}
+
+	for _, sess := range sessions {
+		sess.ctrl.Send(&tunnel.Message{Type: tunnel.MsgClose, Close: &tunnel.Close{Reason: "server shut down"}})
+		sess.mux.Close()
+	}
+	s.logger.LogInfoMessage().Msg("Server shut down")
+	return err
+}
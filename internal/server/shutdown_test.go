@@ -0,0 +1,38 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/harsh082ip/ZapTun/config"
+)
+
+func TestShutdownWaitsForStreams(t *testing.T) {
+	s := newTestServer(&config.ServerConfig{})
+	if !s.beginStreams(1) {
+		t.Fatal("beginStreams refused before Shutdown")
+	}
+
+	drained := make(chan error)
+	go func() { drained <- s.Shutdown(context.Background()) }()
+	select {
+	case <-drained:
+		t.Fatal("Shutdown returned with a stream in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// streams opened during the drain would race with its Wait
+	if s.beginStreams(1) {
+		t.Error("beginStreams counted a stream while draining")
+	}
+	s.streams.Done()
+	select {
+	case err := <-drained:
+		if err != nil {
+			t.Errorf("Shutdown: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Shutdown did not return after the last stream")
+	}
+}
@@ -0,0 +1,242 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/harsh082ip/ZapTun/pkg/db/redis"
+	"github.com/harsh082ip/ZapTun/pkg/tunnel"
+)
+
+const (
+	tokenKeyPrefix   = "zaptun:token"
+	tokenIndexPrefix = "zaptun:tokens"
+	tokenLockPrefix  = "zaptun:lock:tokens"
+
+	// how often live sessions are checked against tokens revoked on other servers
+	revocationCheckInterval = 15 * time.Second
+)
+
+// tokenStore keeps the named machine tokens of every user in the KV store. A
+// token is the record behind the session credentials issued to one machine:
+// deleting it revokes them. Records expire with their credential.
+type tokenStore struct {
+	kv redis.RedisStoreWithRetries
+}
+
+func newTokenID() string {
+	b := make([]byte, 6)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func tokenKey(login, id string) string {
+	return fmt.Sprintf("%s:%s:%s", tokenKeyPrefix, login, id)
+}
+
+func tokenIndexKey(login string) string {
+	return fmt.Sprintf("%s:%s", tokenIndexPrefix, login)
+}
+
+// lock serializes changes to the token index of login.
+func (ts *tokenStore) lock(login string) error {
+	key := fmt.Sprintf("%s:%s", tokenLockPrefix, login)
+	acquired, err := ts.kv.AcquireLockWithMaxRetries(key, login, reservationLockTTL, storeRetries)
+	if err != nil {
+		return err
+	}
+	if !acquired {
+		return fmt.Errorf("tokens are being modified, try again")
+	}
+	return nil
+}
+
+func (ts *tokenStore) unlock(login string) {
+	ts.kv.ReleaseLockWithMaxRetries(fmt.Sprintf("%s:%s", tokenLockPrefix, login), storeRetries)
+}
+
+// lookup returns the token login/id, or nil if it was revoked or has expired.
+func (ts *tokenStore) lookup(login, id string) (*tunnel.TokenInfo, error) {
+	var t tunnel.TokenInfo
+	if found, err := redis.GetJSONIfExists(ts.kv, tokenKey(login, id), &t); err != nil || !found {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func (ts *tokenStore) index(login string) ([]string, error) {
+	var ids []string
+	if _, err := redis.GetJSONIfExists(ts.kv, tokenIndexKey(login), &ids); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// save stores t; a new token is also added to the user's index.
+func (ts *tokenStore) save(login string, t *tunnel.TokenInfo, isNew bool) error {
+	if err := ts.kv.SetJSONWithMaxRetries(tokenKey(login, t.ID), t, time.Until(t.ExpiresAt), storeRetries); err != nil {
+		return err
+	}
+	if !isNew {
+		return nil
+	}
+	if err := ts.lock(login); err != nil {
+		return err
+	}
+	defer ts.unlock(login)
+	ids, err := ts.index(login)
+	if err != nil {
+		return err
+	}
+	return ts.kv.SetJSONWithMaxRetries(tokenIndexKey(login), append(ids, t.ID), 0, storeRetries)
+}
+
+// list returns the live tokens of login and drops expired ones from the index.
+func (ts *tokenStore) list(login string) ([]tunnel.TokenInfo, error) {
+	if err := ts.lock(login); err != nil {
+		return nil, err
+	}
+	defer ts.unlock(login)
+	ids, err := ts.index(login)
+	if err != nil {
+		return nil, err
+	}
+	var tokens []tunnel.TokenInfo
+	live := ids[:0]
+	for _, id := range ids {
+		t, err := ts.lookup(login, id)
+		if err != nil {
+			return nil, err
+		}
+		if t != nil {
+			tokens = append(tokens, *t)
+			live = append(live, id)
+		}
+	}
+	if len(live) != len(ids) {
+		if err := ts.kv.SetJSONWithMaxRetries(tokenIndexKey(login), live, 0, storeRetries); err != nil {
+			return nil, err
+		}
+	}
+	return tokens, nil
+}
+
+// rename changes the name of the token login/id.
+func (ts *tokenStore) rename(login, id, name string) (*tunnel.TokenInfo, error) {
+	t, err := ts.lookup(login, id)
+	if err != nil {
+		return nil, err
+	}
+	if t == nil {
+		return nil, &tunnel.Error{Code: tunnel.ErrNotFound, Message: fmt.Sprintf("you have no token %s", id)}
+	}
+	t.Name = name
+	return t, ts.save(login, t, false)
+}
+
+// revoke deletes the token login/id, which invalidates its credentials at once.
+func (ts *tokenStore) revoke(login, id string) (*tunnel.TokenInfo, error) {
+	t, err := ts.lookup(login, id)
+	if err != nil {
+		return nil, err
+	}
+	if t == nil {
+		return nil, &tunnel.Error{Code: tunnel.ErrNotFound, Message: fmt.Sprintf("you have no token %s", id)}
+	}
+	if err := ts.kv.DelWithMaxRetries(tokenKey(login, id), storeRetries); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// handleTokenCommand serves the list, rename and revoke token commands of a session.
+func (s *Server) handleTokenCommand(sess *Session, msg *tunnel.Message) {
+	login := sess.user.Login
+	var tokens []tunnel.TokenInfo
+	var err error
+
+	switch {
+	case s.credentials == nil:
+		err = &tunnel.Error{Code: tunnel.ErrBadRequest, Message: "machine tokens are disabled on this server"}
+
+	case msg.Type == tunnel.MsgListTokens:
+		tokens, err = s.tokens.list(login)
+
+	case msg.Type == tunnel.MsgRenameToken:
+		name := strings.TrimSpace(msg.Token.Name)
+		if name == "" {
+			err = &tunnel.Error{Code: tunnel.ErrBadRequest, Message: "a token name is required"}
+			break
+		}
+		var renamed *tunnel.TokenInfo
+		if renamed, err = s.tokens.rename(login, msg.Token.ID, name); err == nil {
+			tokens = []tunnel.TokenInfo{*renamed}
+		}
+
+	case msg.Type == tunnel.MsgRevokeToken:
+		var revoked *tunnel.TokenInfo
+		if revoked, err = s.tokens.revoke(login, msg.Token.ID); err == nil {
+			tokens = []tunnel.TokenInfo{*revoked}
+		}
+	}
+
+	if err != nil {
+		s.replyError(sess, fmt.Sprintf("Token command %s", msg.Type), err)
+		return
+	}
+	for i := range tokens {
+		tokens[i].Current = tokens[i].ID == sess.tokenID
+	}
+	sess.ctrl.Send(&tunnel.Message{Type: tunnel.MsgTokens, Tokens: tokens})
+
+	if msg.Type == tunnel.MsgRevokeToken {
+		s.logger.LogInfoMessage().Msgf("%s revoked token %s (%q)", login, tokens[0].ID, tokens[0].Name)
+		s.cutRevokedSessions(func(sess *Session) bool {
+			return sess.user.Login == login && sess.tokenID == tokens[0].ID
+		})
+	}
+}
+
+// cutRevokedSessions disconnects the live sessions for which revoked is true.
+func (s *Server) cutRevokedSessions(revoked func(*Session) bool) {
+	s.mutex.RLock()
+	var sessions []*Session
+	for sess := range s.sessions {
+		if sess.tokenID != "" {
+			sessions = append(sessions, sess)
+		}
+	}
+	s.mutex.RUnlock()
+
+	// revoked may ask the KV store, so it runs outside the lock
+	for _, sess := range sessions {
+		if !revoked(sess) {
+			continue
+		}
+		s.logger.LogWarnMessage().Msgf("Token %s of %s was revoked, closing session", sess.tokenID, sess.user.Login)
+		sess.ctrl.Send(tokenRejected(errTokenRevoked))
+		sess.mux.Close()
+	}
+}
+
+// watchRevokedTokens periodically cuts sessions whose token was revoked through
+// another server sharing the KV store.
+func (s *Server) watchRevokedTokens(ctx context.Context) {
+	ticker := time.NewTicker(revocationCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		s.cutRevokedSessions(func(sess *Session) bool {
+			t, err := s.tokens.lookup(sess.user.Login, sess.tokenID)
+			return err == nil && t == nil
+		})
+	}
+}
@@ -0,0 +1,161 @@
+package redis
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"sync"
+	"time"
+)
+
+// MemoryStore is an in-process stand-in for RedisClient. It implements the same
+// interfaces so the server can run without a Redis instance, but nothing
+// survives a restart.
+type MemoryStore struct {
+	mutex sync.Mutex
+	items map[string]memoryItem
+}
+
+type memoryItem struct {
+	value     []byte
+	expiresAt time.Time // zero means no expiry
+}
+
+// NewMemoryStore creates an empty in-memory store
+func NewMemoryStore() RedisStoreWithRetries {
+	return &MemoryStore{items: make(map[string]memoryItem)}
+}
+
+// get returns the live item for key, dropping it if it has expired.
+// The caller must hold m.mutex.
+func (m *MemoryStore) get(key string) (memoryItem, bool) {
+	item, ok := m.items[key]
+	if !ok {
+		return item, false
+	}
+	if !item.expiresAt.IsZero() && time.Now().After(item.expiresAt) {
+		delete(m.items, key)
+		return item, false
+	}
+	return item, true
+}
+
+// set stores value under key. The caller must hold m.mutex.
+func (m *MemoryStore) set(key string, value []byte, ttl time.Duration) {
+	item := memoryItem{value: value}
+	if ttl > 0 {
+		item.expiresAt = time.Now().Add(ttl)
+	}
+	m.items[key] = item
+}
+
+// Close is a no-op for the in-memory store
+func (m *MemoryStore) Close() error {
+	return nil
+}
+
+// SafeFlushPattern deletes all keys matching a glob pattern
+func (m *MemoryStore) SafeFlushPattern(pattern string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for key := range m.items {
+		matched, err := path.Match(pattern, key)
+		if err != nil {
+			return fmt.Errorf("error matching keys: %v", err)
+		}
+		if matched {
+			delete(m.items, key)
+		}
+	}
+	return nil
+}
+
+// SafeFlushPatternWithMaxRetries deletes all keys matching a pattern
+func (m *MemoryStore) SafeFlushPatternWithMaxRetries(pattern string, maxRetries int) error {
+	return m.SafeFlushPattern(pattern)
+}
+
+// GetJSON retrieves a JSON value and unmarshals it
+func (m *MemoryStore) GetJSON(key string, out interface{}) error {
+	m.mutex.Lock()
+	item, ok := m.get(key)
+	m.mutex.Unlock()
+	if !ok {
+		return fmt.Errorf("key not found")
+	}
+	return json.Unmarshal(item.value, out)
+}
+
+// GetJSONWithMaxRetries retrieves a JSON value and unmarshals it
+func (m *MemoryStore) GetJSONWithMaxRetries(key string, out interface{}, maxRetries int) error {
+	return m.GetJSON(key, out)
+}
+
+// SetJSON marshals a value to JSON and stores it
+func (m *MemoryStore) SetJSON(key string, value interface{}, ttl time.Duration) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("failed to marshal value: %v", err)
+	}
+	m.mutex.Lock()
+	m.set(key, data, ttl)
+	m.mutex.Unlock()
+	return nil
+}
+
+// SetJSONWithMaxRetries marshals a value to JSON and stores it
+func (m *MemoryStore) SetJSONWithMaxRetries(key string, value interface{}, ttl time.Duration, maxRetries int) error {
+	return m.SetJSON(key, value, ttl)
+}
+
+// Exists checks if a key exists
+func (m *MemoryStore) Exists(key string) (bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	_, ok := m.get(key)
+	return ok, nil
+}
+
+// ExistsWithMaxRetries checks if a key exists
+func (m *MemoryStore) ExistsWithMaxRetries(key string, maxRetries int) (bool, error) {
+	return m.Exists(key)
+}
+
+// Del deletes a key
+func (m *MemoryStore) Del(key string) error {
+	m.mutex.Lock()
+	delete(m.items, key)
+	m.mutex.Unlock()
+	return nil
+}
+
+// DelWithMaxRetries deletes a key
+func (m *MemoryStore) DelWithMaxRetries(key string, maxRetries int) error {
+	return m.Del(key)
+}
+
+// AcquireLock sets lockKey only if it does not exist yet, like SETNX
+func (m *MemoryStore) AcquireLock(lockKey string, lockValue interface{}, ttl time.Duration) (bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, ok := m.get(lockKey); ok {
+		return false, nil
+	}
+	m.set(lockKey, []byte(fmt.Sprint(lockValue)), ttl)
+	return true, nil
+}
+
+// AcquireLockWithMaxRetries sets lockKey only if it does not exist yet
+func (m *MemoryStore) AcquireLockWithMaxRetries(lockKey string, lockValue interface{}, ttl time.Duration, maxRetries int) (bool, error) {
+	return m.AcquireLock(lockKey, lockValue, ttl)
+}
+
+// ReleaseLock releases a lock
+func (m *MemoryStore) ReleaseLock(lockKey string) error {
+	return m.Del(lockKey)
+}
+
+// ReleaseLockWithMaxRetries releases a lock
+func (m *MemoryStore) ReleaseLockWithMaxRetries(lockKey string, maxRetries int) error {
+	return m.ReleaseLock(lockKey)
+}
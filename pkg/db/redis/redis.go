@@ -57,6 +57,19 @@ type RedisStoreWithRetries interface {
 	LockManagerWithRetries
 }
 
+// GetJSONIfExists reads key into out like GetJSON and reports whether the key
+// exists; a missing key is not an error.
+func GetJSONIfExists(store KVStore, key string, out interface{}) (bool, error) {
+	exists, err := store.Exists(key)
+	if err != nil || !exists {
+		return false, err
+	}
+	if err := store.GetJSON(key, out); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
 // RedisClient implements the RedisStoreWithRetries interface
 type RedisClient struct {
 	client *redis.Client
@@ -0,0 +1,103 @@
+package tunnel
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// FeatureHeartbeat enables application-level ping/pong on the control stream.
+const FeatureHeartbeat = "heartbeat"
+
+// Ping is the payload of MsgPing and MsgPong; a pong echoes the ping it answers.
+type Ping struct {
+	Seq    uint64 `json:"seq"`
+	SentAt int64  `json:"sent_at"` // unix nanoseconds on the sender's clock
+}
+
+// Heartbeat pings the peer over a ControlConn, answers the peer's pings and
+// declares the peer dead when nothing was received for the timeout.
+type Heartbeat struct {
+	conn      *ControlConn
+	interval  time.Duration
+	timeout   time.Duration
+	onTimeout func()
+	onRTT     func(time.Duration)
+
+	lastSeen atomic.Int64 // unix nanoseconds
+	rtt      atomic.Int64
+	seq      atomic.Uint64
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// StartHeartbeat attaches a heartbeat to c and starts pinging every interval.
+// From then on Recv answers pings and records pongs without returning them.
+// onTimeout is called once if the peer stays silent for timeout, onRTT (may be
+// nil) after every pong. Recv must keep being called for liveness to be noticed.
+func (c *ControlConn) StartHeartbeat(interval, timeout time.Duration, onTimeout func(), onRTT func(time.Duration)) *Heartbeat {
+	h := &Heartbeat{
+		conn:      c,
+		interval:  interval,
+		timeout:   timeout,
+		onTimeout: onTimeout,
+		onRTT:     onRTT,
+		stop:      make(chan struct{}),
+	}
+	h.lastSeen.Store(time.Now().UnixNano())
+	c.heartbeat = h
+	go h.run()
+	return h
+}
+
+// RTT returns the round-trip time measured by the latest pong, or 0 before the first one.
+func (h *Heartbeat) RTT() time.Duration {
+	return time.Duration(h.rtt.Load())
+}
+
+// Stop ends the ping loop. It is safe to call more than once.
+func (h *Heartbeat) Stop() {
+	h.stopOnce.Do(func() { close(h.stop) })
+}
+
+func (h *Heartbeat) run() {
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.stop:
+			return
+		case now := <-ticker.C:
+			if now.Sub(time.Unix(0, h.lastSeen.Load())) > h.timeout {
+				h.Stop()
+				h.onTimeout()
+				return
+			}
+			ping := &Ping{Seq: h.seq.Add(1), SentAt: now.UnixNano()}
+			h.conn.Send(&Message{Type: MsgPing, Ping: ping})
+		}
+	}
+}
+
+// handle records that the peer is alive and consumes ping and pong messages.
+// It reports whether msg was consumed.
+func (h *Heartbeat) handle(msg *Message) bool {
+	h.lastSeen.Store(time.Now().UnixNano())
+	switch msg.Type {
+	case MsgPing:
+		if msg.Ping != nil {
+			h.conn.Send(&Message{Type: MsgPong, Ping: msg.Ping})
+		}
+		return true
+	case MsgPong:
+		if msg.Ping != nil && msg.Ping.SentAt > 0 {
+			rtt := time.Since(time.Unix(0, msg.Ping.SentAt))
+			h.rtt.Store(int64(rtt))
+			if h.onRTT != nil {
+				h.onRTT(rtt)
+			}
+		}
+		return true
+	}
+	return false
+}
@@ -1,6 +1,349 @@
 package tunnel
 
-type ControlMessage struct {
-	Type      string `json:"type"` // http or tcp
-	Subdomain string `json:"subdomain,omitempty"`
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// ProtocolVersion is the control-stream protocol version spoken by this build.
+// MinProtocolVersion is the oldest version a server built from this tree still accepts.
+// Version 2 starts every proxied stream with a StreamHeader frame, which version 1
+// clients would read as visitor bytes.
+const (
+	ProtocolVersion    = 2
+	MinProtocolVersion = 2
+)
+
+// Version is the release version of the zaptun binaries, set at build time with
+// -ldflags "-X github.com/harsh082ip/ZapTun/pkg/tunnel.Version=v1.2.3".
+var Version = "dev"
+
+// SupportedFeatures lists the optional protocol features implemented by this build.
+// Both sides advertise their list during the handshake and only use the intersection.
+var SupportedFeatures = []string{FeatureHeartbeat, FeatureUpgrade}
+
+// ErrLegacyPeer is returned by Recv when the peer speaks the old line-based
+// handshake (a bare JSON string token) instead of a Message envelope.
+var ErrLegacyPeer = errors.New("peer speaks the legacy line-based protocol")
+
+type MessageType string
+
+const (
+	MsgHello          MessageType = "hello"
+	MsgAuthResult     MessageType = "auth_result"
+	MsgTunnelRequest  MessageType = "tunnel_request"
+	MsgTunnelAssigned MessageType = "tunnel_assigned"
+	MsgError          MessageType = "error"
+	MsgClose          MessageType = "close"
+	MsgGoAway         MessageType = "go_away"
+	MsgPing           MessageType = "ping"
+	MsgPong           MessageType = "pong"
+
+	// reservation commands, answered with MsgReservations
+	MsgReserve          MessageType = "reserve"
+	MsgRelease          MessageType = "release"
+	MsgListReservations MessageType = "list_reservations"
+	MsgReservations     MessageType = "reservations"
+
+	// token commands, answered with MsgTokens
+	MsgListTokens  MessageType = "list_tokens"
+	MsgRenameToken MessageType = "rename_token"
+	MsgRevokeToken MessageType = "revoke_token"
+	MsgTokens      MessageType = "tokens"
+)
+
+type ErrorCode string
+
+const (
+	ErrUnsupportedVersion  ErrorCode = "unsupported_version"
+	ErrBadRequest          ErrorCode = "bad_request"
+	ErrAuthFailed          ErrorCode = "auth_failed"
+	ErrAccessDenied        ErrorCode = "access_denied"
+	ErrUnknownTunnelType   ErrorCode = "unknown_tunnel_type"
+	ErrTunnelLimit         ErrorCode = "tunnel_limit"
+	ErrPlanRestricted      ErrorCode = "plan_restricted"
+	ErrPortUnavailable     ErrorCode = "port_unavailable"
+	ErrSubdomainTaken      ErrorCode = "subdomain_taken"
+	ErrSubdomainNotAllowed ErrorCode = "subdomain_not_allowed"
+	ErrPortNotAllowed      ErrorCode = "port_not_allowed"
+	ErrReservationLimit    ErrorCode = "reservation_limit"
+	ErrNotFound            ErrorCode = "not_found"
+	ErrGoingAway           ErrorCode = "going_away"
+	ErrInternal            ErrorCode = "internal"
+)
+
+// Message is the envelope for everything sent over the control stream.
+// Exactly one payload field matching Type is set.
+type Message struct {
+	Type           MessageType     `json:"type"`
+	Hello          *Hello          `json:"hello,omitempty"`
+	AuthResult     *AuthResult     `json:"auth_result,omitempty"`
+	TunnelRequest  *TunnelRequest  `json:"tunnel_request,omitempty"`
+	TunnelAssigned *TunnelAssigned `json:"tunnel_assigned,omitempty"`
+	Error          *Error          `json:"error,omitempty"`
+	Close          *Close          `json:"close,omitempty"`
+	GoAway         *GoAway         `json:"go_away,omitempty"`
+	Ping           *Ping           `json:"ping,omitempty"`         // MsgPing, MsgPong
+	Reservation    *Reservation    `json:"reservation,omitempty"`  // MsgReserve, MsgRelease
+	Reservations   []Reservation   `json:"reservations,omitempty"` // MsgReservations
+	Token          *TokenInfo      `json:"token,omitempty"`        // MsgRenameToken, MsgRevokeToken
+	Tokens         []TokenInfo     `json:"tokens,omitempty"`       // MsgTokens
+}
+
+// Hello is the first message a client sends after opening the control stream.
+type Hello struct {
+	ProtocolVersion int      `json:"protocol_version"`
+	ClientVersion   string   `json:"client_version"`
+	Token           string   `json:"token"`
+	Features        []string `json:"features,omitempty"`
+	// MachineName names the token issued to this machine, usually its hostname
+	MachineName string `json:"machine_name,omitempty"`
+	// ProviderToken is the login a session credential in Token was issued for,
+	// sent along once the credential is due for renewal
+	ProviderToken string `json:"provider_token,omitempty"`
+}
+
+// AuthResult is the server's answer to a successful Hello.
+type AuthResult struct {
+	ProtocolVersion int      `json:"protocol_version"` // negotiated version
+	ServerVersion   string   `json:"server_version"`
+	Login           string   `json:"login"`
+	Features        []string `json:"features,omitempty"` // negotiated features
+
+	// set when FeatureHeartbeat was negotiated
+	HeartbeatIntervalMs int64 `json:"heartbeat_interval_ms,omitempty"`
+	HeartbeatTimeoutMs  int64 `json:"heartbeat_timeout_ms,omitempty"`
+
+	Plan *Plan `json:"plan,omitempty"` // limits that apply to this user
+
+	// Credential replaces the token of the Hello for future connects; set when the
+	// server issued a new or renewed session credential
+	Credential          string `json:"credential,omitempty"`
+	CredentialExpiresAt int64  `json:"credential_expires_at,omitempty"` // unix seconds
+}
+
+// CredentialPrefix starts every session credential, which tells it apart from
+// the provider token it replaces.
+const CredentialPrefix = "ztc_"
+
+// Plan is a set of per-user limits. Zero numeric limits mean unlimited.
+type Plan struct {
+	Name                 string `json:"name"`
+	MaxHTTPTunnels       int    `json:"max_http_tunnels"`
+	MaxTCPTunnels        int    `json:"max_tcp_tunnels"`
+	MaxStreams           int    `json:"max_streams"`             // concurrent proxied requests and connections
+	BandwidthBytesPerSec int64  `json:"bandwidth_bytes_per_sec"` // shared by all tunnels of the user
+	MaxReservations      int    `json:"max_reservations"`
+	CustomSubdomains     bool   `json:"custom_subdomains"`
+}
+
+type TunnelRequest struct {
+	Type       string `json:"type"`                  // http or tcp
+	Subdomain  string `json:"subdomain,omitempty"`   // http only, served as <subdomain>-<login>
+	RemotePort int    `json:"remote_port,omitempty"` // tcp only, must be reserved by the user
+	// ResumeToken from a previous TunnelAssigned asks for the same public address again
+	ResumeToken string `json:"resume_token,omitempty"`
+}
+
+type TunnelAssigned struct {
+	TunnelID   string `json:"tunnel_id"`
+	Type       string `json:"type"`
+	PublicAddr string `json:"public_addr"` // host for http tunnels, host:port for tcp tunnels
+	// ResumeToken reclaims this address after a reconnect, within the server's grace period
+	ResumeToken string `json:"resume_token,omitempty"`
+}
+
+// Reasons for ErrAccessDenied, reported in Error.Reason.
+const (
+	DenyListed        = "deny_listed"
+	DenyNotAllowed    = "not_allowlisted"
+	DenyAccountTooNew = "account_too_new"
+)
+
+// Reasons for ErrAuthFailed, reported in Error.Reason.
+const (
+	AuthTokenRevoked = "token_revoked"
+	AuthTokenExpired = "token_expired"
+	AuthLockedOut    = "locked_out" // too many failed logins, see Error.Message for when to retry
+)
+
+// Error is a structured failure reported by the peer. Clients should switch on
+// Code (and Reason, where a code documents one) and only display Message.
+type Error struct {
+	Code    ErrorCode `json:"code"`
+	Reason  string    `json:"reason,omitempty"`
+	Message string    `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+const (
+	ReservationSubdomain = "subdomain"
+	ReservationTCPPort   = "tcp_port"
+)
+
+// Reservation is a subdomain or public TCP port that persistently belongs to one user.
+type Reservation struct {
+	Kind      string    `json:"kind"` // ReservationSubdomain or ReservationTCPPort
+	Name      string    `json:"name,omitempty"`
+	Port      int       `json:"port,omitempty"`
+	Owner     string    `json:"owner,omitempty"`
+	CreatedAt time.Time `json:"created_at,omitempty"`
+}
+
+// TokenInfo describes one of the user's named machine tokens, the session
+// credentials issued to each machine the user logged in from.
+type TokenInfo struct {
+	ID         string    `json:"id"`
+	Name       string    `json:"name,omitempty"`
+	CreatedAt  time.Time `json:"created_at,omitempty"`
+	LastUsedAt time.Time `json:"last_used_at,omitempty"`
+	ExpiresAt  time.Time `json:"expires_at,omitempty"`
+	Current    bool      `json:"current,omitempty"` // the token of the asking session
+}
+
+// GoAway tells the client that the server is shutting down. In-flight streams are
+// allowed to finish, then the server closes the session; the client should wait
+// ReconnectAfterMs before reconnecting.
+type GoAway struct {
+	Reason           string `json:"reason"`
+	ReconnectAfterMs int64  `json:"reconnect_after_ms"`
+}
+
+type Close struct {
+	Reason string `json:"reason,omitempty"`
+}
+
+// NewError builds an error message envelope.
+func NewError(code ErrorCode, format string, args ...interface{}) *Message {
+	return &Message{Type: MsgError, Error: &Error{Code: code, Message: fmt.Sprintf(format, args...)}}
+}
+
+// NegotiateFeatures returns the features present in both lists, in the order of local.
+func NegotiateFeatures(local, remote []string) []string {
+	var common []string
+	for _, l := range local {
+		for _, r := range remote {
+			if l == r {
+				common = append(common, l)
+				break
+			}
+		}
+	}
+	return common
+}
+
+// HasFeature reports whether name is in features.
+func HasFeature(features []string, name string) bool {
+	for _, f := range features {
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
+
+// ControlConn reads and writes newline-delimited Message envelopes on a control stream.
+// Send is safe for concurrent use; Recv must only be called from one goroutine.
+type ControlConn struct {
+	rw        io.ReadWriter
+	dec       *json.Decoder
+	wmu       sync.Mutex
+	heartbeat *Heartbeat
+}
+
+func NewControlConn(rw io.ReadWriter) *ControlConn {
+	return &ControlConn{rw: rw, dec: json.NewDecoder(rw)}
+}
+
+func (c *ControlConn) Send(msg *Message) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return json.NewEncoder(c.rw).Encode(msg)
+}
+
+func (c *ControlConn) Recv() (*Message, error) {
+	for {
+		msg, err := c.recv()
+		if err != nil {
+			return nil, err
+		}
+		if c.heartbeat != nil && c.heartbeat.handle(msg) {
+			continue
+		}
+		return msg, nil
+	}
+}
+
+func (c *ControlConn) recv() (*Message, error) {
+	var raw json.RawMessage
+	if err := c.dec.Decode(&raw); err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(bytes.TrimSpace(raw), []byte(`"`)) {
+		return nil, ErrLegacyPeer
+	}
+	var msg Message
+	if err := json.Unmarshal(raw, &msg); err != nil {
+		return nil, fmt.Errorf("malformed control message: %w", err)
+	}
+	return &msg, nil
+}
+
+// Expect receives the next message and checks that it has type t. If the peer
+// sent an error message instead, its *Error is returned.
+func (c *ControlConn) Expect(t MessageType) (*Message, error) {
+	msg, err := c.Recv()
+	if err != nil {
+		return nil, err
+	}
+	if err := msg.CheckType(t); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// CheckType checks that m has type t and a payload. For an error message the
+// peer's *Error is returned.
+func (m *Message) CheckType(t MessageType) error {
+	if m.Type == MsgError && m.Error != nil {
+		return m.Error
+	}
+	if m.Type != t {
+		return fmt.Errorf("unexpected control message %q, want %q", m.Type, t)
+	}
+	if !m.Valid() {
+		return fmt.Errorf("control message %q without payload", m.Type)
+	}
+	return nil
+}
+
+// Valid reports whether the payload field matching Type is set.
+func (m *Message) Valid() bool {
+	switch m.Type {
+	case MsgHello:
+		return m.Hello != nil
+	case MsgAuthResult:
+		return m.AuthResult != nil
+	case MsgTunnelRequest:
+		return m.TunnelRequest != nil
+	case MsgTunnelAssigned:
+		return m.TunnelAssigned != nil
+	case MsgError:
+		return m.Error != nil
+	case MsgGoAway:
+		return m.GoAway != nil
+	case MsgReserve, MsgRelease:
+		return m.Reservation != nil
+	case MsgRenameToken, MsgRevokeToken:
+		return m.Token != nil
+	}
+	return true
 }
@@ -0,0 +1,110 @@
+package tunnel
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// maxStreamHeaderSize bounds the header frame so a broken peer cannot make us allocate
+// arbitrary amounts of memory.
+const maxStreamHeaderSize = 16 << 10
+
+// StreamHeader is written by the server at the start of every proxied stream, before
+// any visitor bytes, so the client can route the stream to the right local service
+// and knows who is on the other end without trusting headers the visitor can forge.
+type StreamHeader struct {
+	TunnelID    string     `json:"tunnel_id"`
+	Protocol    string     `json:"protocol,omitempty"`     // http or tcp
+	VisitorAddr string     `json:"visitor_addr,omitempty"` // ip:port of the public visitor, only ip behind a reverse proxy
+	RequestID   string     `json:"request_id,omitempty"`   // unique per stream, for correlating logs
+	TLS         *StreamTLS `json:"tls,omitempty"`          // set when the visitor connected over TLS
+}
+
+// StreamTLS describes the visitor's TLS connection. The fields are empty when TLS
+// was terminated by a reverse proxy in front of the server.
+type StreamTLS struct {
+	Version     string `json:"version,omitempty"`
+	CipherSuite string `json:"cipher_suite,omitempty"`
+	ServerName  string `json:"server_name,omitempty"`
+}
+
+// VisitorIP returns the IP part of VisitorAddr, or nil if it is unknown.
+func (h *StreamHeader) VisitorIP() net.IP {
+	host, _, err := net.SplitHostPort(h.VisitorAddr)
+	if err != nil {
+		host = h.VisitorAddr
+	}
+	return net.ParseIP(host)
+}
+
+// FeatureUpgrade means the client relays both directions of an HTTP stream after
+// a protocol switch (101 Switching Protocols), as WebSocket needs.
+const FeatureUpgrade = "upgrade"
+
+// IsUpgrade reports whether h asks to switch protocols, e.g. to WebSocket.
+func IsUpgrade(h http.Header) bool {
+	if h.Get("Upgrade") == "" {
+		return false
+	}
+	for _, value := range h.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// HopHeaders apply to a single HTTP/1.1 connection and are not relayed to the
+// other side of a tunnel, where the connection may well be HTTP/2.
+var HopHeaders = []string{"Connection", "Keep-Alive", "Proxy-Connection", "Transfer-Encoding", "Upgrade"}
+
+// NewRequestID returns a random identifier for a proxied stream.
+func NewRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// WriteStreamHeader writes h as a 4-byte big-endian length followed by its JSON encoding.
+func WriteStreamHeader(w io.Writer, h *StreamHeader) error {
+	payload, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	frame := make([]byte, 4+len(payload))
+	binary.BigEndian.PutUint32(frame, uint32(len(payload)))
+	copy(frame[4:], payload)
+	_, err = w.Write(frame)
+	return err
+}
+
+// ReadStreamHeader reads exactly one header frame from r, leaving the rest of the
+// stream untouched.
+func ReadStreamHeader(r io.Reader) (*StreamHeader, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n > maxStreamHeaderSize {
+		return nil, fmt.Errorf("stream header too large: %d bytes", n)
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	var h StreamHeader
+	if err := json.Unmarshal(payload, &h); err != nil {
+		return nil, fmt.Errorf("malformed stream header: %w", err)
+	}
+	return &h, nil
+}
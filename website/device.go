@@ -0,0 +1,524 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/harsh082ip/ZapTun/internal/server/github"
+	"github.com/harsh082ip/ZapTun/internal/server/netaddr"
+)
+
+// Device authorization (RFC 8628 style): the CLI asks for a device code, the user
+// enters the short user code at /device, signs in with GitHub or SSO and approves
+// the device, and the CLI polls /device/token until the token is ready.
+
+const (
+	deviceCodeTTL      = 10 * time.Minute
+	devicePollInterval = 5 * time.Second
+
+	// /device/code needs no login, so pending codes are capped overall and per
+	// client address; a code stays pending until it is picked up or expires
+	maxPendingDeviceCodes = 10000
+	maxDeviceCodesPerAddr = 10
+
+	// no vowels, so codes never spell words; no digits that look like letters
+	userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+	userCodeLength   = 8
+
+	// browserCookie identifies the browser a device login runs in, see browserToken
+	browserCookie = "zaptun_device"
+)
+
+var (
+	errTooManyDeviceCodes = errors.New("too many pending device codes")
+	errAddrRateLimited    = errors.New("too many device codes requested from this address")
+)
+
+type deviceAuth struct {
+	deviceCode string
+	addr       string
+	userCode   string
+	expiresAt  time.Time
+	interval   time.Duration
+	lastPoll   time.Time
+	token      string
+	denied     bool
+}
+
+// deviceLogin is one sign-in for a device authorization, from entering the code
+// to approving the device.
+type deviceLogin struct {
+	device  *deviceAuth
+	browser string // the browser token of the page the code was entered on
+	token   string // provider token, released to the CLI once the device is approved
+}
+
+type deviceStore struct {
+	mu       sync.Mutex
+	byDevice map[string]*deviceAuth
+	byUser   map[string]*deviceAuth
+	byState  map[string]*deviceLogin
+	byAddr   map[string]int // pending codes per client address
+}
+
+var devices = newDeviceStore()
+
+func newDeviceStore() *deviceStore {
+	return &deviceStore{
+		byDevice: make(map[string]*deviceAuth),
+		byUser:   make(map[string]*deviceAuth),
+		byState:  make(map[string]*deviceLogin),
+		byAddr:   make(map[string]int),
+	}
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func newUserCode() string {
+	var code strings.Builder
+	for i := 0; i < userCodeLength; i++ {
+		if i == userCodeLength/2 {
+			code.WriteByte('-')
+		}
+		n, _ := rand.Int(rand.Reader, big.NewInt(int64(len(userCodeAlphabet))))
+		code.WriteByte(userCodeAlphabet[n.Int64()])
+	}
+	return code.String()
+}
+
+// normalizeUserCode accepts what people type: lowercase, spaces, with or without the dash.
+func normalizeUserCode(code string) string {
+	var letters strings.Builder
+	for _, c := range strings.ToUpper(code) {
+		if c >= 'A' && c <= 'Z' {
+			letters.WriteRune(c)
+		}
+	}
+	s := letters.String()
+	if len(s) != userCodeLength {
+		return s
+	}
+	return s[:userCodeLength/2] + "-" + s[userCodeLength/2:]
+}
+
+// remove forgets d, the caller holds mu.
+func (s *deviceStore) remove(d *deviceAuth) {
+	delete(s.byDevice, d.deviceCode)
+	delete(s.byUser, d.userCode)
+	if s.byAddr[d.addr]--; s.byAddr[d.addr] <= 0 {
+		delete(s.byAddr, d.addr)
+	}
+	for state, login := range s.byState {
+		if login.device == d {
+			delete(s.byState, state)
+		}
+	}
+}
+
+// create starts a device authorization requested from addr, unless too many are
+// pending already.
+func (s *deviceStore) create(addr string) (*deviceAuth, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for _, d := range s.byDevice {
+		if now.After(d.expiresAt) {
+			s.remove(d)
+		}
+	}
+	if s.byAddr[addr] >= maxDeviceCodesPerAddr {
+		return nil, errAddrRateLimited
+	}
+	if len(s.byDevice) >= maxPendingDeviceCodes {
+		return nil, errTooManyDeviceCodes
+	}
+	d := &deviceAuth{
+		deviceCode: randomHex(32),
+		addr:       addr,
+		expiresAt:  now.Add(deviceCodeTTL),
+		interval:   devicePollInterval,
+	}
+	for d.userCode == "" || s.byUser[d.userCode] != nil {
+		d.userCode = newUserCode()
+	}
+	s.byDevice[d.deviceCode] = d
+	s.byUser[d.userCode] = d
+	s.byAddr[addr]++
+	return d, nil
+}
+
+// begin returns a fresh OAuth state for the pending authorization with userCode,
+// entered in the browser identified by browser.
+func (s *deviceStore) begin(userCode, browser string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d := s.byUser[normalizeUserCode(userCode)]
+	if d == nil || time.Now().After(d.expiresAt) || d.token != "" || d.denied {
+		return "", false
+	}
+	state := randomHex(16)
+	s.byState[state] = &deviceLogin{device: d, browser: browser}
+	return state, true
+}
+
+// login returns the unfinished login started with state in browser, the caller
+// holds mu.
+func (s *deviceStore) login(state, browser string) *deviceLogin {
+	l := s.byState[state]
+	if l == nil || l.browser != browser || time.Now().After(l.device.expiresAt) || l.device.token != "" || l.device.denied {
+		return nil
+	}
+	return l
+}
+
+// signedIn records the outcome of the OAuth round trip started with state and
+// returns the user code of the device. An empty token means the user canceled at
+// the provider, which denies the device right away; a token is only kept until
+// approve releases it.
+func (s *deviceStore) signedIn(state, browser, token string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l := s.login(state, browser)
+	if l == nil || l.token != "" {
+		return "", false
+	}
+	if token == "" {
+		l.device.denied = true
+		delete(s.byState, state)
+	}
+	l.token = token
+	return l.device.userCode, true
+}
+
+// approve hands the token of the signed in login started with state to the CLI,
+// or denies the device.
+func (s *deviceStore) approve(state, browser string, approved bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l := s.login(state, browser)
+	if l == nil || l.token == "" {
+		return false
+	}
+	delete(s.byState, state)
+	if approved {
+		l.device.token = l.token
+	} else {
+		l.device.denied = true
+	}
+	return true
+}
+
+// poll answers a token request for deviceCode. It returns the token once, or
+// the RFC 8628 error code telling the CLI what to do next.
+func (s *deviceStore) poll(deviceCode string) (token, errCode string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d := s.byDevice[deviceCode]
+	now := time.Now()
+	switch {
+	case d == nil || now.After(d.expiresAt):
+		return "", "expired_token"
+	case d.denied:
+		s.remove(d)
+		return "", "access_denied"
+	case d.token != "":
+		s.remove(d)
+		return d.token, ""
+	case now.Sub(d.lastPoll) < d.interval:
+		d.interval += devicePollInterval
+		d.lastPoll = now
+		return "", "slow_down"
+	}
+	d.lastPoll = now
+	return "", "authorization_pending"
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// trustedProxies are the reverse proxies in front of the website whose
+// X-Forwarded-For is believed, loopback unless TRUSTED_PROXIES lists others.
+var trustedProxies = []*net.IPNet{
+	{IP: net.IPv4(127, 0, 0, 0), Mask: net.CIDRMask(8, 32)},
+	{IP: net.IPv6loopback, Mask: net.CIDRMask(128, 128)},
+}
+
+// parseTrustedProxies reads a comma separated list of addresses and CIDR ranges.
+func parseTrustedProxies(list string) ([]*net.IPNet, error) {
+	var proxies []*net.IPNet
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", entry)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q", entry)
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies, nil
+}
+
+func isTrustedProxy(ip net.IP) bool {
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP is the address of the client behind r. Requests from a trusted proxy
+// name the client in X-Forwarded-For; it is the last entry not added by one of
+// our proxies, earlier ones can be forged.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	peer := net.ParseIP(host)
+	if peer == nil || !isTrustedProxy(peer) {
+		return host
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		host = hop.String()
+		if !isTrustedProxy(hop) {
+			break
+		}
+	}
+	return host
+}
+
+// requestAddr is the client address of r as the per-address cap counts it, see
+// netaddr.Group.
+func requestAddr(r *http.Request) string {
+	return netaddr.Group(clientIP(r))
+}
+
+func deviceCodeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	d, err := devices.create(requestAddr(r))
+	switch {
+	case errors.Is(err, errAddrRateLimited):
+		w.Header().Set("Retry-After", strconv.Itoa(int(deviceCodeTTL.Seconds())))
+		writeJSON(w, http.StatusTooManyRequests, map[string]string{"error": "slow_down"})
+		return
+	case err != nil:
+		log.Printf("refusing device code: %s", err)
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "temporarily_unavailable"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"device_code":               d.deviceCode,
+		"user_code":                 d.userCode,
+		"verification_uri":          publicURL + "/device",
+		"verification_uri_complete": publicURL + "/device?code=" + d.userCode,
+		"expires_in":                int(deviceCodeTTL.Seconds()),
+		"interval":                  int(devicePollInterval.Seconds()),
+	})
+}
+
+func deviceTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil || r.FormValue("device_code") == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_request"})
+		return
+	}
+	token, errCode := devices.poll(r.FormValue("device_code"))
+	if errCode != "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": errCode})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"access_token": token, "token_type": "bearer"})
+}
+
+// browserToken returns the token identifying the browser of r, and sets the
+// cookie when it has none yet. The device forms echo it as csrf_token, and a
+// device login can only be finished in the browser that started it.
+func browserToken(w http.ResponseWriter, r *http.Request) string {
+	if c, err := r.Cookie(browserCookie); err == nil && c.Value != "" {
+		return c.Value
+	}
+	token := randomHex(32)
+	http.SetCookie(w, &http.Cookie{
+		Name:     browserCookie,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(publicURL, "https://"),
+		// sent along when the provider redirects back, but not with forms
+		// posted from other sites
+		SameSite: http.SameSiteLaxMode,
+	})
+	return token
+}
+
+// postedBrowser returns the browser token of a form posted with r, if the form
+// carries the same token as the cookie.
+func postedBrowser(r *http.Request) (string, bool) {
+	c, err := r.Cookie(browserCookie)
+	if err != nil || c.Value == "" {
+		return "", false
+	}
+	if subtle.ConstantTimeCompare([]byte(c.Value), []byte(r.PostFormValue("csrf_token"))) != 1 {
+		return "", false
+	}
+	return c.Value, true
+}
+
+// devicePage shows the code entry form, or starts the OAuth flow for a submitted code.
+func devicePage(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	code := r.FormValue("code")
+	if r.Method != http.MethodPost {
+		renderDevicePage(w, r, http.StatusOK, code, "Enter the code shown in your terminal.")
+		return
+	}
+	browser, ok := postedBrowser(r)
+	if !ok {
+		renderDevicePage(w, r, http.StatusForbidden, code, "This form has expired, please submit the code again.")
+		return
+	}
+	auth := oauth
+	if auth == nil || (r.FormValue("provider") == "oidc" && sso != nil) {
+		auth = sso
+	}
+	state, ok := devices.begin(code, browser)
+	if !ok {
+		renderDevicePage(w, r, http.StatusNotFound, code, "That code is invalid or has expired. Run <code>zaptun-client auth login</code> again.")
+		return
+	}
+	authUrl := auth.GetOAuthUrl(state)
+	if authUrl == "" {
+		renderDevicePage(w, r, http.StatusBadGateway, code, "The identity provider is unavailable, please try again later.")
+		return
+	}
+	http.Redirect(w, r, authUrl, http.StatusFound)
+}
+
+// loginButtons offers one submit button per configured identity provider.
+func loginButtons() string {
+	var buttons strings.Builder
+	if oauth != nil {
+		buttons.WriteString(`<button class="submit-button" type="submit" name="provider" value="github">Continue with GitHub</button>`)
+	}
+	if sso != nil {
+		buttons.WriteString(`<button class="submit-button" type="submit" name="provider" value="oidc">Continue with SSO</button>`)
+	}
+	return buttons.String()
+}
+
+func renderDevicePage(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	page := strings.Replace(deviceHtml, "##CODE##", template.HTMLEscapeString(code), 1)
+	page = strings.Replace(page, "##MESSAGE##", message, 1)
+	page = strings.Replace(page, "##CSRF##", browserToken(w, r), 1)
+	page = strings.Replace(page, "##BUTTONS##", loginButtons(), 1)
+	w.Header().Set("Content-Type", "text/html")
+	w.WriteHeader(status)
+	w.Write([]byte(page))
+}
+
+// deviceCallback finishes the OAuth round trip of a device login and asks the
+// user to approve the device.
+func deviceCallback(w http.ResponseWriter, r *http.Request, auth github.Authenticator, state string) {
+	var token string
+	if code := r.FormValue("code"); code != "" {
+		var err error
+		token, err = auth.ExchangeCodeForToken(code)
+		if err != nil || token == "" {
+			log.Printf("error obtaining token for device login: %s", err)
+			renderDevicePage(w, r, http.StatusBadGateway, "", "Could not obtain a token from the identity provider. Please try again.")
+			return
+		}
+	}
+	var browser string
+	if c, err := r.Cookie(browserCookie); err == nil {
+		browser = c.Value
+	}
+	userCode, ok := devices.signedIn(state, browser, token)
+	if !ok {
+		renderDevicePage(w, r, http.StatusNotFound, "", "This login request has expired. Run <code>zaptun-client auth login</code> again.")
+		return
+	}
+	if token == "" {
+		renderDevicePage(w, r, http.StatusOK, "", "Access was denied, the CLI has not been logged in.")
+		return
+	}
+	// providers skip their consent screen for returning users, so this page is
+	// the one place where the user sees which device gets the token
+	page := strings.Replace(deviceApproveHtml, "##CODE##", template.HTMLEscapeString(userCode), 1)
+	page = strings.Replace(page, "##STATE##", template.HTMLEscapeString(state), 1)
+	page = strings.Replace(page, "##CSRF##", template.HTMLEscapeString(browser), 1)
+	w.Header().Set("Content-Type", "text/html")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write([]byte(page))
+}
+
+// deviceApprove releases the token of a signed in device login to the CLI, or
+// denies the device.
+func deviceApprove(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	browser, ok := postedBrowser(r)
+	approved := r.PostFormValue("decision") == "approve"
+	if !ok || !devices.approve(r.PostFormValue("state"), browser, approved) {
+		renderDevicePage(w, r, http.StatusNotFound, "", "This login request has expired. Run <code>zaptun-client auth login</code> again.")
+		return
+	}
+	if !approved {
+		renderDevicePage(w, r, http.StatusOK, "", "The device was denied, the CLI has not been logged in.")
+		return
+	}
+	w.Header().Set("Content-Type", "text/html")
+	w.Write([]byte(deviceDoneHtml))
+}
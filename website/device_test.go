@@ -0,0 +1,332 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/harsh082ip/ZapTun/internal/server/github"
+)
+
+// newFakeProvider serves the GitHub OAuth token endpoint, handing out gho_device
+// for the code "granted".
+func newFakeProvider(t *testing.T) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/login/oauth/access_token" || r.FormValue("code") != "granted" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		io.WriteString(w, `{"access_token": "gho_device"}`)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// setupDeviceFlow points the website at a fake provider with fresh device state.
+func setupDeviceFlow(t *testing.T) {
+	provider := newFakeProvider(t)
+	prevAuth, prevDevices := oauth, devices
+	oauth = github.NewWithEndpoints("id", "secret", github.Endpoints{WebURL: provider.URL, RedirectURI: "http://website/auth-callback"})
+	devices = newDeviceStore()
+	t.Cleanup(func() { oauth, devices = prevAuth, prevDevices })
+}
+
+type deviceCodeResponse struct {
+	DeviceCode string `json:"device_code"`
+	UserCode   string `json:"user_code"`
+	Error      string `json:"error"`
+}
+
+func requestDeviceCode(t *testing.T, remoteAddr string) (*httptest.ResponseRecorder, deviceCodeResponse) {
+	req := httptest.NewRequest(http.MethodPost, "/device/code", nil)
+	req.RemoteAddr = remoteAddr
+	rec := httptest.NewRecorder()
+	deviceCodeHandler(rec, req)
+	var code deviceCodeResponse
+	json.NewDecoder(rec.Body).Decode(&code)
+	return rec, code
+}
+
+func pollToken(t *testing.T, deviceCode string) (token, errCode string) {
+	req := httptest.NewRequest(http.MethodPost, "/device/token", strings.NewReader(url.Values{"device_code": {deviceCode}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	deviceTokenHandler(rec, req)
+	var resp struct {
+		AccessToken string `json:"access_token"`
+		Error       string `json:"error"`
+	}
+	json.NewDecoder(rec.Body).Decode(&resp)
+	return resp.AccessToken, resp.Error
+}
+
+// browser keeps the cookie a browser gets on the /device page.
+type browser struct {
+	cookie *http.Cookie
+}
+
+// newBrowser opens the /device page in a fresh browser.
+func newBrowser(t *testing.T) *browser {
+	rec := httptest.NewRecorder()
+	devicePage(rec, httptest.NewRequest(http.MethodGet, "/device", nil))
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == browserCookie && c.SameSite == http.SameSiteLaxMode && c.HttpOnly {
+			if !strings.Contains(rec.Body.String(), `name="csrf_token" value="`+c.Value+`"`) {
+				t.Fatal("the /device form does not carry the CSRF token")
+			}
+			return &browser{cookie: c}
+		}
+	}
+	t.Fatalf("GET /device set no browser cookie: %v", rec.Result().Cookies())
+	return nil
+}
+
+// post submits form, including the CSRF token, to handler.
+func (b *browser) post(handler http.HandlerFunc, path string, form url.Values) *httptest.ResponseRecorder {
+	form.Set("csrf_token", b.cookie.Value)
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(b.cookie)
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	return rec
+}
+
+// signIn enters userCode at /device and returns the OAuth state of the redirect.
+func (b *browser) signIn(t *testing.T, userCode string) string {
+	rec := b.post(devicePage, "/device", url.Values{"code": {userCode}, "provider": {"github"}})
+	if rec.Code != http.StatusFound {
+		t.Fatalf("POST /device = %d, want a redirect to the provider", rec.Code)
+	}
+	loc, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil || loc.Query().Get("state") == "" {
+		t.Fatalf("redirect %q carries no state", rec.Header().Get("Location"))
+	}
+	return loc.Query().Get("state")
+}
+
+// callback follows the provider's redirect back to the website.
+func (b *browser) callback(query url.Values) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/auth-callback?"+query.Encode(), nil)
+	req.AddCookie(b.cookie)
+	rec := httptest.NewRecorder()
+	authCallback(oauth, "/auth")(rec, req)
+	return rec
+}
+
+func (b *browser) approve(state, decision string) int {
+	return b.post(deviceApprove, "/device/approve", url.Values{"state": {state}, "decision": {decision}}).Code
+}
+
+func TestDeviceFlow(t *testing.T) {
+	setupDeviceFlow(t)
+	rec, code := requestDeviceCode(t, "192.0.2.1:4000")
+	if rec.Code != http.StatusOK || code.DeviceCode == "" || code.UserCode == "" {
+		t.Fatalf("POST /device/code = %d %+v", rec.Code, code)
+	}
+
+	if _, errCode := pollToken(t, code.DeviceCode); errCode != "authorization_pending" {
+		t.Errorf("first poll: %q, want authorization_pending", errCode)
+	}
+	if _, errCode := pollToken(t, code.DeviceCode); errCode != "slow_down" {
+		t.Errorf("immediate second poll: %q, want slow_down", errCode)
+	}
+
+	// people type the code in lowercase and without the dash
+	b := newBrowser(t)
+	state := b.signIn(t, strings.ToLower(strings.ReplaceAll(code.UserCode, "-", "")))
+	rec = b.callback(url.Values{"code": {"granted"}, "state": {state}})
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), code.UserCode) {
+		t.Fatalf("callback = %d, want 200 asking to approve %s", rec.Code, code.UserCode)
+	}
+	if rec := b.callback(url.Values{"code": {"granted"}, "state": {state}}); rec.Code != http.StatusNotFound {
+		t.Errorf("replayed callback = %d, want 404", rec.Code)
+	}
+	// signing in alone does not release the token
+	devices.byDevice[code.DeviceCode].lastPoll = time.Time{}
+	if token, errCode := pollToken(t, code.DeviceCode); token != "" || errCode != "authorization_pending" {
+		t.Errorf("poll before approval = %q, %q, want authorization_pending", token, errCode)
+	}
+
+	if status := b.approve(state, "approve"); status != http.StatusOK {
+		t.Fatalf("approve = %d, want 200", status)
+	}
+	if status := b.approve(state, "approve"); status != http.StatusNotFound {
+		t.Errorf("replayed approval = %d, want 404", status)
+	}
+	devices.byDevice[code.DeviceCode].lastPoll = time.Time{}
+	if token, errCode := pollToken(t, code.DeviceCode); token != "device" || errCode != "" {
+		t.Fatalf("poll after approval = %q, %q, want the token", token, errCode)
+	}
+	// the token is handed out once
+	if _, errCode := pollToken(t, code.DeviceCode); errCode != "expired_token" {
+		t.Errorf("poll after pickup: %q, want expired_token", errCode)
+	}
+}
+
+func TestDeviceFlowDenied(t *testing.T) {
+	setupDeviceFlow(t)
+	_, code := requestDeviceCode(t, "192.0.2.1:4000")
+	b := newBrowser(t)
+	state := b.signIn(t, code.UserCode)
+	// the provider redirects back without a code when the user cancels
+	if rec := b.callback(url.Values{"error": {"access_denied"}, "state": {state}}); rec.Code != http.StatusOK {
+		t.Fatalf("callback = %d, want 200", rec.Code)
+	}
+	if _, errCode := pollToken(t, code.DeviceCode); errCode != "access_denied" {
+		t.Errorf("poll: %q, want access_denied", errCode)
+	}
+
+	// or denies the device after signing in
+	_, code = requestDeviceCode(t, "192.0.2.1:4000")
+	state = b.signIn(t, code.UserCode)
+	b.callback(url.Values{"code": {"granted"}, "state": {state}})
+	if status := b.approve(state, "deny"); status != http.StatusOK {
+		t.Fatalf("deny = %d, want 200", status)
+	}
+	if token, errCode := pollToken(t, code.DeviceCode); token != "" || errCode != "access_denied" {
+		t.Errorf("poll after denial = %q, %q, want access_denied", token, errCode)
+	}
+}
+
+func TestDeviceLoginBoundToBrowser(t *testing.T) {
+	setupDeviceFlow(t)
+	_, code := requestDeviceCode(t, "192.0.2.1:4000")
+	victim, attacker := newBrowser(t), newBrowser(t)
+
+	// a form posted from another site carries no cookie, or not the matching token
+	req := httptest.NewRequest(http.MethodPost, "/device", strings.NewReader(url.Values{"code": {code.UserCode}, "csrf_token": {attacker.cookie.Value}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	devicePage(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("POST /device without the cookie = %d, want 403", rec.Code)
+	}
+	req = httptest.NewRequest(http.MethodPost, "/device", strings.NewReader(url.Values{"code": {code.UserCode}, "csrf_token": {attacker.cookie.Value}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(victim.cookie)
+	rec = httptest.NewRecorder()
+	devicePage(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("POST /device with another token = %d, want 403", rec.Code)
+	}
+
+	// a login started in one browser cannot be finished in another
+	state := attacker.signIn(t, code.UserCode)
+	if rec := victim.callback(url.Values{"code": {"granted"}, "state": {state}}); rec.Code != http.StatusNotFound {
+		t.Errorf("callback in another browser = %d, want 404", rec.Code)
+	}
+	state = victim.signIn(t, code.UserCode)
+	victim.callback(url.Values{"code": {"granted"}, "state": {state}})
+	if status := attacker.approve(state, "approve"); status != http.StatusNotFound {
+		t.Errorf("approval from another browser = %d, want 404", status)
+	}
+	if status := victim.approve(state, "approve"); status != http.StatusOK {
+		t.Errorf("approval = %d, want 200", status)
+	}
+}
+
+func TestDeviceCodeExpires(t *testing.T) {
+	setupDeviceFlow(t)
+	_, code := requestDeviceCode(t, "192.0.2.1:4000")
+	devices.byDevice[code.DeviceCode].expiresAt = time.Now().Add(-time.Second)
+
+	rec := newBrowser(t).post(devicePage, "/device", url.Values{"code": {code.UserCode}})
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("POST /device with an expired code = %d, want 404", rec.Code)
+	}
+	if _, errCode := pollToken(t, code.DeviceCode); errCode != "expired_token" {
+		t.Errorf("poll: %q, want expired_token", errCode)
+	}
+}
+
+func TestDeviceCodeLimits(t *testing.T) {
+	setupDeviceFlow(t)
+	for i := 0; i < maxDeviceCodesPerAddr; i++ {
+		if rec, _ := requestDeviceCode(t, "192.0.2.1:4000"); rec.Code != http.StatusOK {
+			t.Fatalf("code #%d = %d, want 200", i, rec.Code)
+		}
+	}
+	rec, code := requestDeviceCode(t, "192.0.2.1:4001")
+	if rec.Code != http.StatusTooManyRequests || code.Error != "slow_down" || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("code over the address limit = %d %+v, want 429 slow_down", rec.Code, code)
+	}
+	// IPv6 clients are limited per /64
+	for i := 0; i < maxDeviceCodesPerAddr; i++ {
+		requestDeviceCode(t, "[2001:db8::1]:4000")
+	}
+	if rec, _ := requestDeviceCode(t, "[2001:db8::2]:4000"); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("code from the same /64 = %d, want 429", rec.Code)
+	}
+	if rec, _ := requestDeviceCode(t, "192.0.2.2:4000"); rec.Code != http.StatusOK {
+		t.Errorf("code from another address = %d, want 200", rec.Code)
+	}
+
+	// expired codes no longer count
+	for _, d := range devices.byDevice {
+		d.expiresAt = time.Now().Add(-time.Second)
+	}
+	if rec, _ := requestDeviceCode(t, "192.0.2.1:4000"); rec.Code != http.StatusOK {
+		t.Errorf("code after the others expired = %d, want 200", rec.Code)
+	}
+
+	// and all pending codes together are capped
+	for i := len(devices.byDevice); i < maxPendingDeviceCodes; i++ {
+		if _, err := devices.create(fmt.Sprintf("10.0.%d.%d", i/256, i%256)); err != nil {
+			t.Fatalf("create #%d: %v", i, err)
+		}
+	}
+	if rec, code := requestDeviceCode(t, "192.0.2.3:4000"); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("code over the overall cap = %d %+v, want 503", rec.Code, code)
+	}
+}
+
+func TestDeviceCodeBehindProxy(t *testing.T) {
+	setupDeviceFlow(t)
+	prevProxies := trustedProxies
+	t.Cleanup(func() { trustedProxies = prevProxies })
+	var err error
+	if trustedProxies, err = parseTrustedProxies("127.0.0.1, 10.1.0.0/16"); err != nil {
+		t.Fatal(err)
+	}
+
+	fromProxy := func(forwardedFor string) int {
+		req := httptest.NewRequest(http.MethodPost, "/device/code", nil)
+		req.RemoteAddr = "127.0.0.1:5000"
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+		rec := httptest.NewRecorder()
+		deviceCodeHandler(rec, req)
+		return rec.Code
+	}
+	for i := 0; i < maxDeviceCodesPerAddr; i++ {
+		// earlier entries are up to the client, the proxy chain only appends
+		if status := fromProxy(fmt.Sprintf("198.51.100.%d, 192.0.2.1, 10.1.2.3", i)); status != http.StatusOK {
+			t.Fatalf("code #%d = %d, want 200", i, status)
+		}
+	}
+	if status := fromProxy("192.0.2.1"); status != http.StatusTooManyRequests {
+		t.Errorf("code over the limit of the forwarded address = %d, want 429", status)
+	}
+	// the proxy itself is not limited, each client behind it is
+	if status := fromProxy("192.0.2.2"); status != http.StatusOK {
+		t.Errorf("code for another client behind the proxy = %d, want 200", status)
+	}
+
+	// X-Forwarded-For of untrusted peers is ignored
+	req := httptest.NewRequest(http.MethodPost, "/device/code", nil)
+	req.RemoteAddr = "203.0.113.7:5000"
+	req.Header.Set("X-Forwarded-For", "192.0.2.9")
+	if addr := requestAddr(req); addr != "203.0.113.7" {
+		t.Errorf("requestAddr of an untrusted peer = %q, want its own address", addr)
+	}
+
+	if _, err := parseTrustedProxies("10.0.0.0/33"); err == nil {
+		t.Error("parseTrustedProxies accepted an invalid range")
+	}
+}
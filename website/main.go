@@ -9,9 +9,15 @@ import (
 	"strings"
 
 	"github.com/harsh082ip/ZapTun/internal/server/github"
+	"github.com/harsh082ip/ZapTun/internal/server/oidc"
 )
 
-var oauth github.Authenticator
+// oauth signs users in with GitHub and sso with an OpenID Connect provider; at
+// least one of them is configured
+var oauth, sso github.Authenticator
+
+// publicURL is where users reach this website, https://zaptun.com unless PUBLIC_URL is set
+var publicURL = "https://zaptun.com"
 
 //go:embed static/config.json
 var config string
@@ -22,6 +28,15 @@ var html string
 //go:embed static/token.html
 var tokenHtml string
 
+//go:embed static/device.html
+var deviceHtml string
+
+//go:embed static/device-approve.html
+var deviceApproveHtml string
+
+//go:embed static/device-done.html
+var deviceDoneHtml string
+
 //go:embed static/install.sh
 var install string
 
@@ -29,12 +44,39 @@ var install string
 var ps1Installer string
 
 func main() {
+	if u := os.Getenv("PUBLIC_URL"); u != "" {
+		publicURL = strings.TrimRight(u, "/")
+	}
+	if list := os.Getenv("TRUSTED_PROXIES"); list != "" {
+		proxies, err := parseTrustedProxies(list)
+		if err != nil {
+			log.Fatalf("TRUSTED_PROXIES: %s", err)
+		}
+		trustedProxies = proxies
+	}
 	clientId := os.Getenv("GITHUB_CLIENT_ID")
 	clientSecret := os.Getenv("GITHUB_CLIENT_SECRET")
-	if clientId == "" || clientSecret == "" {
-		log.Fatalf("missing github client id/secret")
+	if clientId != "" && clientSecret != "" {
+		// GITHUB_URL and GITHUB_API_URL point at GitHub Enterprise or a fake provider in development
+		oauth = github.NewWithEndpoints(clientId, clientSecret, github.Endpoints{
+			WebURL:      os.Getenv("GITHUB_URL"),
+			APIURL:      os.Getenv("GITHUB_API_URL"),
+			RedirectURI: publicURL + "/auth-callback",
+		})
+	}
+	if issuer := os.Getenv("OIDC_ISSUER"); issuer != "" {
+		sso = oidc.New(oidc.Config{
+			Issuer:       issuer,
+			ClientID:     os.Getenv("OIDC_CLIENT_ID"),
+			ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+			RedirectURI:  publicURL + "/auth/oidc/callback",
+			LoginClaim:   os.Getenv("OIDC_LOGIN_CLAIM"),
+			GroupsClaim:  os.Getenv("OIDC_GROUPS_CLAIM"),
+		})
+	}
+	if oauth == nil && sso == nil {
+		log.Fatalf("missing github client id/secret or oidc issuer")
 	}
-	oauth = github.New(clientId, clientSecret)
 
 	log.Println("Starting server on http://localhost:8883")
 
@@ -42,8 +84,20 @@ func main() {
 	http.HandleFunc("/config.json", serveStaticContent([]byte(config), "application/json"))
 	http.HandleFunc("/install.sh", serveStaticContent([]byte(install), "text/x-shellscript"))
 	http.HandleFunc("/install.ps1", serveStaticContent([]byte(ps1Installer), "application/octet-stream"))
-	http.HandleFunc("/auth", authHandler)
-	http.HandleFunc("/auth-callback", authCallback)
+	if oauth != nil {
+		http.HandleFunc("/auth", authHandler(oauth))
+		http.HandleFunc("/auth-callback", authCallback(oauth, "/auth"))
+	} else {
+		http.Handle("/auth", http.RedirectHandler("/auth/oidc", http.StatusFound))
+	}
+	if sso != nil {
+		http.HandleFunc("/auth/oidc", authHandler(sso))
+		http.HandleFunc("/auth/oidc/callback", authCallback(sso, "/auth/oidc"))
+	}
+	http.HandleFunc("/device", devicePage)
+	http.HandleFunc("/device/approve", deviceApprove)
+	http.HandleFunc("/device/code", deviceCodeHandler)
+	http.HandleFunc("/device/token", deviceTokenHandler)
 	log.Fatal(http.ListenAndServe(":8883", nil))
 }
 
@@ -54,22 +108,36 @@ func serveStaticContent(content []byte, contentType string) func(w http.Response
 	}
 }
 
-func authHandler(w http.ResponseWriter, r *http.Request) {
-	http.Redirect(w, r, oauth.GetOAuthUrl(), http.StatusFound)
+func authHandler(auth github.Authenticator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		authUrl := auth.GetOAuthUrl("")
+		if authUrl == "" {
+			http.Error(w, "identity provider unavailable, try again later", http.StatusBadGateway)
+			return
+		}
+		http.Redirect(w, r, authUrl, http.StatusFound)
+	}
 }
 
-func authCallback(w http.ResponseWriter, r *http.Request) {
-	if err := r.ParseForm(); err != nil || r.FormValue("code") == "" {
-		http.Redirect(w, r, "/auth", http.StatusTemporaryRedirect)
-		return
-	}
-	token, err := oauth.ExchangeCodeForToken(r.FormValue("code"))
-	if err != nil || token == "" {
-		fmt.Printf("error obtaining token: %s\n", err)
-		http.Redirect(w, r, "/auth", http.StatusTemporaryRedirect)
-		return
+// authCallback finishes a login started at loginPath.
+func authCallback(auth github.Authenticator, loginPath string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err == nil && r.FormValue("state") != "" {
+			deviceCallback(w, r, auth, r.FormValue("state"))
+			return
+		}
+		if r.FormValue("code") == "" {
+			http.Redirect(w, r, loginPath, http.StatusTemporaryRedirect)
+			return
+		}
+		token, err := auth.ExchangeCodeForToken(r.FormValue("code"))
+		if err != nil || token == "" {
+			fmt.Printf("error obtaining token: %s\n", err)
+			http.Redirect(w, r, loginPath, http.StatusTemporaryRedirect)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		// TO:
+		w.Write([]byte(strings.Replace(tokenHtml, "##TOKEN##", token, 1)))
 	}
-	w.Header().Set("Content-Type", "text/html")
-	// TO:
-	w.Write([]byte(strings.Replace(tokenHtml, "##TOKEN##", token, 1)))
 }